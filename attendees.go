@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/models"
+)
+
+// legacyGroupMembers are the flat group member fields purchase requests had
+// before attendees. They are only read so old clients keep working; the buy
+// form posts Attendees.
+type legacyGroupMembers struct {
+	GroupMember2FirstName   string
+	GroupMember2LastName    string
+	GroupMember2Email       string
+	GroupMember2PhoneNumber string
+
+	GroupMember3FirstName   string
+	GroupMember3LastName    string
+	GroupMember3Email       string
+	GroupMember3PhoneNumber string
+
+	GroupMember4FirstName   string
+	GroupMember4LastName    string
+	GroupMember4Email       string
+	GroupMember4PhoneNumber string
+}
+
+// attendees returns the group members that were filled in.
+func (l legacyGroupMembers) attendees() []models.Attendee {
+	members := []models.Attendee{
+		{FirstName: l.GroupMember2FirstName, LastName: l.GroupMember2LastName, Email: l.GroupMember2Email, PhoneNumber: l.GroupMember2PhoneNumber},
+		{FirstName: l.GroupMember3FirstName, LastName: l.GroupMember3LastName, Email: l.GroupMember3Email, PhoneNumber: l.GroupMember3PhoneNumber},
+		{FirstName: l.GroupMember4FirstName, LastName: l.GroupMember4LastName, Email: l.GroupMember4Email, PhoneNumber: l.GroupMember4PhoneNumber},
+	}
+	var filled []models.Attendee
+	for _, a := range members {
+		if len(strings.TrimSpace(a.FirstName+a.LastName+a.Email+a.PhoneNumber)) > 0 {
+			filled = append(filled, a)
+		}
+	}
+	return filled
+}
+
+// decodePurchaseRequest reads a purchase request from a buyer. Legacy group
+// member fields become attendees after the buyer.
+func decodePurchaseRequest(r io.Reader, req *models.PurchaseRequest) error {
+	body := struct {
+		*models.PurchaseRequest
+		legacyGroupMembers
+	}{PurchaseRequest: req}
+	if err := json.NewDecoder(r).Decode(&body); err != nil {
+		return err
+	}
+	if members := body.attendees(); len(req.Attendees) == 0 && len(members) > 0 {
+		req.Attendees = append([]models.Attendee{req.BuyerAttendee()}, members...)
+	}
+	return nil
+}
+
+// checkAttendees returns an error for the buyer if pr doesn't have one
+// attendee per seat of tt.
+func checkAttendees(tt *models.TicketType, pr *models.PurchaseRequest) error {
+	if len(pr.Attendees) != tt.Seats {
+		return withCode("attendee_count", fmt.Errorf("%s tickets are for %d people, but %d were given", tt.Name, tt.Seats, len(pr.Attendees)))
+	}
+	return nil
+}
+
+// validateAttendees checks every attendee of pr has a name, phone number and
+// valid email that no other attendee uses and that doesn't already have a
+// ticket for event.
+func (s *server) validateAttendees(event *models.Event, pr *models.PurchaseRequest) error {
+	var errs fieldErrors
+	add := func(i int, field, code, format string, args ...interface{}) {
+		errs = append(errs, FieldError{
+			Field:   fmt.Sprintf("Attendees[%d].%s", i, field),
+			Code:    code,
+			Message: fmt.Sprintf("Attendee %d: ", i+1) + fmt.Sprintf(format, args...),
+		})
+	}
+	seen := make(map[string]int)
+	var emails []string
+	for i, a := range pr.Attendees {
+		if len(strings.TrimSpace(a.FirstName)) == 0 {
+			add(i, "FirstName", "required", "first name is required.")
+		}
+		if len(strings.TrimSpace(a.LastName)) == 0 {
+			add(i, "LastName", "required", "last name is required.")
+		}
+		if len(strings.TrimSpace(a.PhoneNumber)) == 0 {
+			add(i, "PhoneNumber", "required", "phone number is required.")
+		}
+		email := strings.ToLower(strings.TrimSpace(a.Email))
+		if len(email) == 0 {
+			add(i, "Email", "required", "email is required.")
+			continue
+		}
+		if !govalidator.IsEmail(email) {
+			add(i, "Email", "invalid", "%s is not a valid email address.", a.Email)
+			continue
+		}
+		if j, ok := seen[email]; ok {
+			add(i, "Email", "duplicate", "%s is already used by attendee %d.", a.Email, j+1)
+			continue
+		}
+		seen[email] = i
+		emails = append(emails, email)
+	}
+
+	if len(emails) > 0 {
+		var holders []string
+		if err := s.db.Model(&models.Ticket{}).
+			Where("event_id = ? AND LOWER(TRIM(email)) IN (?)", event.ID, emails).
+			Pluck("DISTINCT LOWER(TRIM(email))", &holders).Error; err != nil {
+			return errors.Wrap(err, "db ticket holders")
+		}
+		pending, err := pendingAttendees(s.db, event, emails, pr.ID)
+		if err != nil {
+			return err
+		}
+		held := make(map[string]bool)
+		for _, email := range holders {
+			held[email] = true
+		}
+		for i, a := range pr.Attendees {
+			email := strings.ToLower(strings.TrimSpace(a.Email))
+			if seen[email] != i {
+				continue
+			}
+			if held[email] {
+				add(i, "Email", "has_ticket", "%s already has a ticket for %s.", a.Email, event.Name)
+			} else if id, ok := pending[email]; ok {
+				add(i, "Email", "pending_purchase", "%s", pendingPurchaseMessage(event, a.Email, id))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// pendingAttendees returns which of emails, lowercased and trimmed, are
+// attendees of a purchase for event that is still waiting on payment, other
+// than the purchase request exceptID, mapped to that purchase request's ID.
+// They will get tickets too once it's paid.
+func pendingAttendees(db *gorm.DB, event *models.Event, emails []string, exceptID int) (map[string]int, error) {
+	var rows []struct {
+		Email             string
+		PurchaseRequestID int
+	}
+	if err := db.Table("attendees").
+		Select("LOWER(TRIM(attendees.email)) AS email, purchase_requests.id AS purchase_request_id").
+		Joins("JOIN purchase_requests ON purchase_requests.id = attendees.purchase_request_id").
+		Where("attendees.deleted_at IS NULL AND purchase_requests.deleted_at IS NULL").
+		Where("purchase_requests.event_id = ? AND LOWER(TRIM(attendees.email)) IN (?)", event.ID, emails).
+		Where("purchase_requests.id != ?", exceptID).
+		Where("purchase_requests.paid_at IS NULL AND purchase_requests.canceled_at IS NULL AND "+
+			"purchase_requests.invoice_failed_at IS NULL AND "+
+			"IFNULL(purchase_requests.invoice_state, '') NOT IN (?)", []string{"PAID", "CANCELED", "REFUNDED"}).
+		Where("IFNULL(purchase_requests.invoice_token, '') != '' OR purchase_requests.id IN " +
+			"(SELECT purchase_request_id FROM reservations WHERE released_at IS NULL)").
+		Order("purchase_requests.id").
+		Scan(&rows).Error; err != nil {
+		return nil, errors.Wrap(err, "db pending attendees")
+	}
+	pending := make(map[string]int)
+	for _, row := range rows {
+		if _, ok := pending[row.Email]; !ok {
+			pending[row.Email] = row.PurchaseRequestID
+		}
+	}
+	return pending, nil
+}
+
+// pendingPurchaseMessage tells a buyer that email is already in the unpaid
+// purchase request id, and what to do about it. The invoice is named the way
+// Square shows it so they can find it in their email.
+func pendingPurchaseMessage(event *models.Event, email string, id int) string {
+	return fmt.Sprintf("%s is already in a purchase for %s that hasn't been paid yet, invoice %s. "+
+		"Pay that invoice to get the tickets, or contact us to cancel it before buying again.",
+		email, event.Name, event.InvoiceReference(id))
+}
+
+// prepareAttendees makes pr's attendees ready to be saved with it as new rows,
+// adding the buyer if there are none.
+func prepareAttendees(pr *models.PurchaseRequest) {
+	if len(pr.Attendees) == 0 {
+		pr.Attendees = []models.Attendee{pr.BuyerAttendee()}
+	}
+	for i := range pr.Attendees {
+		pr.Attendees[i].ID = 0
+		pr.Attendees[i].PurchaseRequestID = 0
+		pr.Attendees[i].Position = i
+	}
+}
+
+// orderAttendees is used to preload attendees in order.
+func orderAttendees(db *gorm.DB) *gorm.DB {
+	return db.Order("position")
+}
+
+// attendees returns who pr's tickets are for. A purchase request saved without
+// any attendees is just for the buyer.
+func (s *server) attendees(pr *models.PurchaseRequest) ([]models.Attendee, error) {
+	var attendees []models.Attendee
+	if err := s.db.Where("purchase_request_id = ?", pr.ID).Order("position").Find(&attendees).Error; err != nil {
+		return nil, errors.Wrapf(err, "db attendees of purchase request %d", pr.ID)
+	}
+	if len(attendees) == 0 {
+		attendees = append(attendees, pr.BuyerAttendee())
+	}
+	return attendees, nil
+}
+
+// migrateAttendees creates the attendees of purchase requests from before
+// attendees existed, from the buyer and any legacy group member columns.
+func (s *server) migrateAttendees() error {
+	columns := "id, IFNULL(first_name, ''), IFNULL(last_name, ''), IFNULL(email, ''), " +
+		"IFNULL(phone_number, ''), IFNULL(student_id, '')"
+	legacy := s.db.Dialect().HasColumn("purchase_requests", "group_member2_first_name")
+	if legacy {
+		for n := 2; n <= 4; n++ {
+			for _, field := range []string{"first_name", "last_name", "email", "phone_number"} {
+				columns += fmt.Sprintf(", IFNULL(group_member%d_%s, '')", n, field)
+			}
+		}
+	}
+	rows, err := s.db.Raw("SELECT " + columns + " FROM purchase_requests " +
+		"WHERE id NOT IN (SELECT purchase_request_id FROM attendees)").Rows()
+	if err != nil {
+		return errors.Wrap(err, "db legacy purchase requests")
+	}
+	var prs []models.PurchaseRequest
+	for rows.Next() {
+		var pr models.PurchaseRequest
+		var l legacyGroupMembers
+		dest := []interface{}{&pr.ID, &pr.FirstName, &pr.LastName, &pr.Email, &pr.PhoneNumber, &pr.StudentID}
+		if legacy {
+			dest = append(dest,
+				&l.GroupMember2FirstName, &l.GroupMember2LastName, &l.GroupMember2Email, &l.GroupMember2PhoneNumber,
+				&l.GroupMember3FirstName, &l.GroupMember3LastName, &l.GroupMember3Email, &l.GroupMember3PhoneNumber,
+				&l.GroupMember4FirstName, &l.GroupMember4LastName, &l.GroupMember4Email, &l.GroupMember4PhoneNumber,
+			)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "db scan legacy purchase request")
+		}
+		pr.Attendees = append([]models.Attendee{pr.BuyerAttendee()}, l.attendees()...)
+		prs = append(prs, pr)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "db legacy purchase requests")
+	}
+	if len(prs) == 0 {
+		return nil
+	}
+
+	tx := s.db.Begin()
+	for _, pr := range prs {
+		for i, a := range pr.Attendees {
+			a.PurchaseRequestID = pr.ID
+			a.Position = i
+			if err := tx.Create(&a).Error; err != nil {
+				tx.Rollback()
+				return errors.Wrap(err, "db attendee")
+			}
+		}
+	}
+	return tx.Commit().Error
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/models"
+)
+
+// CheckInRequest is the optional body of a check in.
+type CheckInRequest struct {
+	// By names who is checking the ticket in, e.g. "door-2". It defaults to
+	// the admin username.
+	By string
+}
+
+// checkIn admits the ticket holder on POST, and undoes a check in made by
+// mistake on DELETE. A ticket can only be checked in once.
+func (s *server) checkIn(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	event, err := s.scopedEvent(&r.Request)
+	if err != nil {
+		s.eventErr(w, err)
+		return
+	}
+	ticket, err := s.signedTicket(mux.Vars(&r.Request)["token"])
+	if err != nil {
+		s.ticketErr(w, err)
+		return
+	}
+	if event != nil && ticket.EventID != event.ID {
+		s.err(w, withCode("wrong_event", fmt.Errorf("%s %s's ticket isn't for %s.", ticket.FirstName, ticket.LastName, event.Name)), 400)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		var req CheckInRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			s.err(w, err, 400)
+			return
+		}
+		if len(req.By) == 0 {
+			req.By = r.Username
+		}
+		t := now()
+		q := s.db.Model(ticket).Where("checked_in_at IS NULL").
+			UpdateColumns(map[string]interface{}{"checked_in_at": t, "checked_in_by": req.By})
+		if err := q.Error; err != nil {
+			s.err(w, err, 500)
+			return
+		}
+		if q.RowsAffected == 0 {
+			if err := s.db.Where("id = ?", ticket.ID).First(ticket).Error; err != nil {
+				s.err(w, err, 500)
+				return
+			}
+			s.err(w, withCode("already_checked_in", alreadyCheckedIn(ticket)), 409)
+			return
+		}
+		ticket.CheckedInAt = &t
+		ticket.CheckedInBy = req.By
+	case "DELETE":
+		if err := s.db.Model(ticket).
+			UpdateColumns(map[string]interface{}{"checked_in_at": nil, "checked_in_by": ""}).Error; err != nil {
+			s.err(w, err, 500)
+			return
+		}
+		ticket.CheckedInAt = nil
+		ticket.CheckedInBy = ""
+	default:
+		s.err(w, fmt.Errorf("unknown method %s", r.Method), 400)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(ticket); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
+
+func alreadyCheckedIn(ticket *models.Ticket) error {
+	msg := fmt.Sprintf("%s %s was already checked in", ticket.FirstName, ticket.LastName)
+	if ticket.CheckedInAt != nil {
+		msg += " at " + ticket.CheckedInAt.Local().Format("15:04")
+	}
+	if len(ticket.CheckedInBy) > 0 {
+		msg += " by " + ticket.CheckedInBy
+	}
+	return errors.New(msg + ".")
+}
+
+// Headcount is how many ticket holders have arrived.
+type Headcount struct {
+	Tickets   int
+	CheckedIn int
+	// ByDoor breaks CheckedIn down by who checked people in.
+	ByDoor map[string]int
+}
+
+func (s *server) headcount(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	event, err := s.event(&r.Request)
+	if err != nil {
+		s.eventErr(w, err)
+		return
+	}
+	resp := Headcount{ByDoor: make(map[string]int)}
+	tickets := s.db.Model(&models.Ticket{}).Where("event_id = ?", event.ID)
+	if err := tickets.Count(&resp.Tickets).Error; err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	rows, err := tickets.Where("checked_in_at IS NOT NULL").
+		Select("checked_in_by, COUNT(*)").Group("checked_in_by").Rows()
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var by string
+		var count int
+		if err := rows.Scan(&by, &count); err != nil {
+			s.err(w, err, 500)
+			return
+		}
+		resp.ByDoor[by] = count
+		resp.CheckedIn += count
+	}
+	if err := rows.Err(); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
@@ -1,7 +1,9 @@
 package email
 
 import (
+	"bytes"
 	"flag"
+	"io/ioutil"
 	"log"
 
 	"github.com/jaytaylor/html2text"
@@ -19,7 +21,15 @@ func NewMG() mailgun.Mailgun {
 	return mailgun.NewMailgun(*Domain, *Key, *PubKey)
 }
 
-func SendEmail(to, subj, body string) error {
+// File is attached to an email. Inline files are images the body shows with
+// <img src="cid:Name">.
+type File struct {
+	Name   string
+	Data   []byte
+	Inline bool
+}
+
+func SendEmail(to, subj, body string, files ...File) error {
 	pm := premailer.NewPremailerFromString(body, premailer.NewOptions())
 	message, err := pm.Transform()
 	if err != nil {
@@ -39,6 +49,13 @@ func SendEmail(to, subj, body string) error {
 		to,
 	)
 	m.SetHtml(message)
+	for _, f := range files {
+		if f.Inline {
+			m.AddReaderInline(f.Name, ioutil.NopCloser(bytes.NewReader(f.Data)))
+		} else {
+			m.AddBufferAttachment(f.Name, f.Data)
+		}
+	}
 	log.Printf("To: %s\nSubj: %s\nText:\n%sHTML:\n%s", to, subj, text, message)
 	_, id, err := mg.Send(m)
 	if err != nil {
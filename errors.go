@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/pkg/errors"
+)
+
+// requestIDHeader is set on every response so errors can be matched up with
+// the server logs.
+const requestIDHeader = "X-Request-ID"
+
+// ErrorResponse is the body of every error returned by the API.
+type ErrorResponse struct {
+	// Code is a machine readable error code, e.g. "sold_out".
+	Code string
+	// Message is meant to be shown to the user.
+	Message string
+	// Fields lists the form fields that were invalid, if any.
+	Fields    []FieldError `json:",omitempty"`
+	RequestID string       `json:",omitempty"`
+}
+
+// FieldError is a problem with one field of a submitted form. Field is the
+// JSON path of the field, e.g. "Attendees[1].Email".
+type FieldError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+// fieldErrors is returned when a form has invalid fields.
+type fieldErrors []FieldError
+
+func (errs fieldErrors) Error() string {
+	var msgs []string
+	for _, e := range errs {
+		msgs = append(msgs, e.Message)
+	}
+	return strings.Join(msgs, " ")
+}
+
+// codedError gives an error a more specific code than its status.
+type codedError struct {
+	code string
+	error
+}
+
+func withCode(code string, err error) error {
+	return &codedError{code, err}
+}
+
+// statusCode is the error code used for a status when the error doesn't have
+// a more specific one.
+func statusCode(status int) string {
+	switch status {
+	case 400:
+		return "bad_request"
+	case 401:
+		return "unauthorized"
+	case 404:
+		return "not_found"
+	case 409:
+		return "conflict"
+	case 429:
+		return "rate_limited"
+	case 503:
+		return "unavailable"
+	}
+	if status >= 500 {
+		return "internal"
+	}
+	return "error"
+}
+
+// validatorFields turns the errors from govalidator.ValidateStruct into field
+// errors.
+func validatorFields(errs govalidator.Errors) fieldErrors {
+	var fields fieldErrors
+	for _, err := range errs {
+		switch err := err.(type) {
+		case govalidator.Errors:
+			fields = append(fields, validatorFields(err)...)
+		case govalidator.Error:
+			field := FieldError{Field: err.Name, Code: "invalid", Message: err.Error()}
+			if strings.Contains(err.Err.Error(), "required") {
+				field.Code = "required"
+				field.Message = err.Name + " is required."
+			}
+			fields = append(fields, field)
+		default:
+			fields = append(fields, FieldError{Code: "invalid", Message: err.Error()})
+		}
+	}
+	return fields
+}
+
+// err writes sendErr as an ErrorResponse. Internal errors are logged and,
+// unless running in debug mode, replaced with a message pointing at the
+// request ID.
+func (s *server) err(w http.ResponseWriter, sendErr error, status int) {
+	resp := ErrorResponse{
+		Code:      statusCode(status),
+		Message:   sendErr.Error(),
+		RequestID: w.Header().Get(requestIDHeader),
+	}
+	var coded *codedError
+	if errors.As(sendErr, &coded) {
+		resp.Code = coded.code
+	}
+	var fields fieldErrors
+	var invalid govalidator.Errors
+	if errors.As(sendErr, &fields) {
+		resp.Code = "invalid_fields"
+		resp.Fields = fields
+	} else if errors.As(sendErr, &invalid) {
+		fields = validatorFields(invalid)
+		resp.Code = "invalid_fields"
+		resp.Message = fields.Error()
+		resp.Fields = fields
+	}
+	if status == 500 {
+		log.Printf("request %s: %+v", resp.RequestID, sendErr)
+		if !*debug {
+			resp.Message = "Something went wrong on our end. Please try again later."
+			if len(resp.RequestID) > 0 {
+				resp.Message += " If it keeps happening, contact us with request ID " + resp.RequestID + "."
+			}
+		}
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, resp.Message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// requestIDs gives every request an ID in the response headers.
+type requestIDs struct {
+	h http.Handler
+}
+
+func (ri requestIDs) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	w.Header().Set(requestIDHeader, hex.EncodeToString(buf))
+	ri.h.ServeHTTP(w, r)
+}
+
+// validationStatus is the status to send for an error from validating a
+// request: 400 if it describes a problem with the request, or 500 for internal
+// errors such as from the database.
+func validationStatus(err error) int {
+	var coded *codedError
+	var fields fieldErrors
+	var invalid govalidator.Errors
+	if errors.As(err, &coded) || errors.As(err, &fields) || errors.As(err, &invalid) {
+		return 400
+	}
+	return 500
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/asaskevich/govalidator"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/models"
+)
+
+// defaultEvent is the event created from the command line flags when the
+// database has none, so existing single event deployments keep working.
+func defaultEvent() *models.Event {
+	return &models.Event{
+		Slug:          *eventSlug,
+		Name:          "CSSS Year End Gala",
+		Capacity:      *maxTickets,
+		InvoicePrefix: PRKey,
+		EmailIntro:    "Here's your tickets for the CSSS Year End Gala:",
+		EmailSignoff:  "See you at the gala!<br>The CSSS",
+	}
+}
+
+// migrateEvents creates the default event if there are no events and moves
+// purchase requests and tickets from before events existed into it.
+func (s *server) migrateEvents() error {
+	var count int
+	if err := s.db.Model(&models.Event{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	event := defaultEvent()
+	if err := s.db.Create(event).Error; err != nil {
+		return err
+	}
+	for _, model := range []interface{}{&models.PurchaseRequest{}, &models.Ticket{}} {
+		if err := s.db.Model(model).Where("event_id IS NULL OR event_id = 0").
+			UpdateColumn("event_id", event.ID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// event returns the event named by the request's slug. Routes without a
+// slug use the default event.
+func (s *server) event(r *http.Request) (*models.Event, error) {
+	slug, ok := mux.Vars(r)["slug"]
+	if !ok {
+		slug = *eventSlug
+	}
+	var event models.Event
+	if q := s.db.Where("slug = ?", slug).First(&event); q.RecordNotFound() {
+		return nil, withCode("unknown_event", errors.Errorf("There's no event called %q.", slug))
+	} else if q.Error != nil {
+		return nil, errors.Wrapf(q.Error, "db event %q", slug)
+	}
+	return &event, nil
+}
+
+// eventErr sends an error from event, as a 404 if there's no such event.
+func (s *server) eventErr(w http.ResponseWriter, err error) {
+	status := validationStatus(err)
+	if status == 400 {
+		status = 404
+	}
+	s.err(w, err, status)
+}
+
+// scopedEvent is like event, except it returns nil for routes without a slug
+// so admin lists can show every event.
+func (s *server) scopedEvent(r *http.Request) (*models.Event, error) {
+	if _, ok := mux.Vars(r)["slug"]; !ok {
+		return nil, nil
+	}
+	return s.event(r)
+}
+
+func (s *server) eventByID(id int) (*models.Event, error) {
+	var event models.Event
+	if err := s.db.First(&event, id).Error; err != nil {
+		return nil, errors.Wrapf(err, "event %d", id)
+	}
+	return &event, nil
+}
+
+// EventResponse is the public view of an event.
+type EventResponse struct {
+	Slug     string
+	Name     string
+	Date     time.Time
+	Venue    string
+	Capacity int
+}
+
+func (s *server) listEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var records []*models.Event
+	if err := s.db.Order("date").Find(&records).Error; err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	events := make([]EventResponse, 0, len(records))
+	for _, event := range records {
+		events = append(events, EventResponse{
+			Slug:     event.Slug,
+			Name:     event.Name,
+			Date:     event.Date,
+			Venue:    event.Venue,
+			Capacity: event.Capacity,
+		})
+	}
+	if err := json.NewEncoder(w).Encode(events); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
+
+// saveEvent creates an event on POST. On PATCH only the fields sent are
+// changed, so admins can edit one without resending the rest.
+func (s *server) saveEvent(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.err(w, err, 400)
+		return
+	}
+	var req models.Event
+	var sent map[string]json.RawMessage
+	if err := json.Unmarshal(body, &sent); err != nil {
+		s.err(w, err, 400)
+		return
+	}
+	if r.Method == "PATCH" {
+		var id struct{ ID int }
+		if err := json.Unmarshal(body, &id); err != nil {
+			s.err(w, err, 400)
+			return
+		}
+		if q := s.db.First(&req, id.ID); q.RecordNotFound() {
+			s.err(w, errors.Errorf("no event %d", id.ID), 404)
+			return
+		} else if q.Error != nil {
+			s.err(w, q.Error, 500)
+			return
+		}
+	}
+	slug := req.Slug
+	if err := json.Unmarshal(body, &req); err != nil {
+		s.err(w, err, 400)
+		return
+	}
+	if _, err := govalidator.ValidateStruct(req); err != nil {
+		s.err(w, err, 400)
+		return
+	}
+	// Routes without a slug find the default event by the -event flag.
+	if r.Method == "PATCH" && slug == *eventSlug && req.Slug != slug {
+		s.err(w, errors.Errorf("%s is the default event, restart with -event=%s before renaming it", slug, req.Slug), 400)
+		return
+	}
+	var other models.Event
+	if !s.db.Where("invoice_prefix = ? AND id != ?", req.InvoicePrefix, req.ID).First(&other).RecordNotFound() {
+		s.err(w, fmt.Errorf("invoice prefix %q is already used by %s", req.InvoicePrefix, other.Slug), 400)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		req.ID = 0
+		if err := s.db.Create(&req).Error; err != nil {
+			s.err(w, err, 500)
+			return
+		}
+	case "PATCH":
+		// JSON keys match fields case insensitively, like json.Unmarshal.
+		updates := make(map[string]interface{})
+		for _, field := range s.db.NewScope(&req).Fields() {
+			switch field.Name {
+			case "ID", "CreatedAt", "UpdatedAt", "DeletedAt":
+				continue
+			}
+			for name := range sent {
+				if strings.EqualFold(name, field.Name) && !field.IsIgnored {
+					updates[field.DBName] = field.Field.Interface()
+				}
+			}
+		}
+		if err := s.db.Model(&req).Updates(updates).Error; err != nil {
+			s.err(w, err, 500)
+			return
+		}
+	}
+	if err := json.NewEncoder(w).Encode(req); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
@@ -34,19 +34,61 @@ var (
 	debug         = flag.Bool("debug", false, "whether to run in debug mode")
 	adminPassword = flag.String("pass", "", "the md5 hash of the admin password")
 
-	squareCookies = flag.String("squareCookies", "", "the square cookies")
-	squareEmail   = flag.String("squareEmail", "", "the square email address")
-	squarePass    = flag.String("squarePass", "", "the square password")
-	currency      = flag.String("currency", "CAD", "the currency to use")
+	squareCookies    = flag.String("squareCookies", "", "the square cookies")
+	squareCookieFile = flag.String("squareCookieFile", "square_cookies.json", "where to save the square session cookies, empty to disable")
+	squareEmail      = flag.String("squareEmail", "", "the square email address")
+	squarePass       = flag.String("squarePass", "", "the square password")
 
-	priceGroup        = flag.Float64("priceGroup", 120, "the price for group tickets")
-	priceIndividual   = flag.Float64("priceIndividual", 35, "the price for individual tickets")
-	priceIndividualCS = flag.Float64("priceIndividualCS", 35, "the price for individual tickets in CS")
-	maxTickets        = flag.Int("maxTickets", 160, "the number of tickets that can be sold")
+	squareOrigin    = flag.String("squareOrigin", square.DefaultOrigin, "the square dashboard origin")
+	squareAPIOrigin = flag.String("squareAPIOrigin", square.DefaultAPIOrigin, "the square login API origin")
 
-	poll = flag.Bool("poll", true, "whether to poll square")
+	squareAttempts  = flag.Int("squareAttempts", square.DefaultRetryPolicy.MaxAttempts, "how many times to try idempotent square requests")
+	squareRateLimit = flag.Float64("squareRateLimit", square.DefaultRateLimit, "the maximum square requests per second, negative to disable")
+
+	squareToken      = flag.String("squareToken", "", "the square connect access token; if set the connect API is used instead of the dashboard")
+	squareLocation   = flag.String("squareLocation", "", "the square location ID to invoice from, defaults to the first active location")
+	squareConnectURL = flag.String("squareConnectURL", square.ConnectURL, "the square connect API base URL")
+
+	currency = flag.String("currency", "CAD", "the currency to use")
+
+	eventSlug = flag.String("event", "gala", "the event served by the routes without an event slug")
+
+	priceGroup        = flag.Float64("priceGroup", 120, "the price for group tickets when creating the default event")
+	priceIndividual   = flag.Float64("priceIndividual", 35, "the price for individual tickets when creating the default event")
+	priceIndividualCS = flag.Float64("priceIndividualCS", 35, "the price for individual tickets in CS when creating the default event")
+	maxTickets        = flag.Int("maxTickets", 160, "the number of tickets that can be sold when creating the default event")
+
+	poll              = flag.Bool("poll", true, "whether to poll square")
+	pollInterval      = flag.Duration("pollInterval", 10*time.Second, "how often to poll square when webhooks are disabled")
+	reconcileInterval = flag.Duration("reconcileInterval", 15*time.Minute, "how often to poll square when webhooks are enabled")
+
+	squareWebhookKey = flag.String("squareWebhookKey", "", "the square webhook signature key; enables /api/webhooks/square")
+	squareWebhookURL = flag.String("squareWebhookURL", "https://tickets.ubccsss.org/api/webhooks/square", "the notification URL registered with square")
+
+	ticketKeys = flag.String("ticketKeys", "", "comma separated id:secret keys that sign ticket links; the first signs new links and the rest still verify")
+
+	legacyTicketsBefore    = flag.String("legacyTicketsBefore", "", "tickets issued before this date (YYYY-MM-DD) can still be opened by their old unsigned /ticket/<id> links")
+	legacyTicketLinksUntil = flag.String("legacyTicketLinksUntil", "", "the date (YYYY-MM-DD) old unsigned ticket links stop working")
+
+	passTypeID = flag.String("passTypeID", "", "the Apple Wallet pass type ID; enables /api/ticket/{token}.pkpass")
+	passTeamID = flag.String("passTeamID", "", "the Apple developer team ID that owns the pass type ID")
+	passCert   = flag.String("passCert", "", "the PEM pass type ID certificate that signs passes")
+	passKey    = flag.String("passKey", "", "the PEM private key of the pass certificate")
+	passWWDR   = flag.String("passWWDR", "", "the PEM Apple WWDR intermediate certificate")
+	passImages = flag.String("passImages", "static/img/pass", "the directory of pass images such as icon.png and logo.png")
+
+	googleWalletIssuer = flag.String("googleWalletIssuer", "", "the Google Wallet issuer ID; enables save to Google Wallet links")
+	googleWalletKey    = flag.String("googleWalletKey", "", "the JSON key file of the service account that signs Google Wallet links")
+
+	claimWindow    = flag.Duration("claimWindow", 24*time.Hour, "how long someone on the waitlist has to claim freed up seats")
+	trustProxy     = flag.Bool("trustProxy", false, "rate limit by the client address a reverse proxy adds to X-Forwarded-For; only set it if clients can't reach the server directly")
+	lookupLimit    = flag.Int("lookupLimit", 5, "how many ticket lookups an email address or IP address can make per hour")
+	waitlistLimit  = flag.Int("waitlistLimit", 5, "how many times an email address or IP address can join waitlists per hour")
+	transferWindow = flag.Duration("transferWindow", 24*time.Hour, "how long ticket holders have to confirm a transfer")
+	transferLimit  = flag.Int("transferLimit", 3, "how many transfers can be requested per hour for a ticket or from an IP address")
 )
 
+// PRKey is the invoice prefix of the default event.
 const PRKey = "PurchaseRequest2018"
 
 func main() {
@@ -62,28 +104,80 @@ func main() {
 }
 
 type server struct {
-	db *gorm.DB
+	db       *gorm.DB
+	payments PaymentProvider
+	signer   *ticketSigner
+
+	// passes and googleWallet are nil unless the wallets are set up.
+	passes       *passSigner
+	googleWallet *googleWallet
+
+	// invoiceMu serializes invoice processing between the poller and the
+	// webhook so tickets aren't issued twice.
+	invoiceMu sync.Mutex
+	// seatsMu serializes seat reservations so events aren't oversold.
+	seatsMu sync.Mutex
+
+	// lookupsByIP and lookupsByEmail rate limit ticket lookups.
+	lookupsByIP    *rateLimiter
+	lookupsByEmail *rateLimiter
+	// joinsByIP and joinsByEmail rate limit joining waitlists.
+	joinsByIP    *rateLimiter
+	joinsByEmail *rateLimiter
+	// transfersByTicket and transfersByIP rate limit transfer requests.
+	transfersByTicket *rateLimiter
+	transfersByIP     *rateLimiter
+
+	// background tracks work handlers leave running after they respond.
+	background sync.WaitGroup
 }
 
 func newServer() (*server, error) {
-	s := &server{}
-	db, err := gorm.Open("sqlite3", "tickets.db")
+	s := &server{
+		lookupsByIP:    newRateLimiter(*lookupLimit, time.Hour),
+		lookupsByEmail: newRateLimiter(*lookupLimit, time.Hour),
+		joinsByIP:      newRateLimiter(*waitlistLimit, time.Hour),
+		joinsByEmail:   newRateLimiter(*waitlistLimit, time.Hour),
+
+		transfersByTicket: newRateLimiter(*transferLimit, time.Hour),
+		transfersByIP:     newRateLimiter(*transferLimit, time.Hour),
+	}
+	payments, err := newPaymentProvider()
 	if err != nil {
 		return nil, err
 	}
-	s.db = db
+	s.payments = payments
 
-	if err := db.AutoMigrate(&models.PurchaseRequest{}).Error; err != nil {
+	signer, err := newTicketSigner(*ticketKeys)
+	if err != nil {
+		return nil, err
+	}
+	s.signer = signer
+
+	if s.passes, err = newPassSigner(); err != nil {
+		return nil, err
+	}
+	if s.googleWallet, err = newGoogleWallet(); err != nil {
 		return nil, err
 	}
-	if err := db.AutoMigrate(&models.PromoCode{}).Error; err != nil {
+
+	db, err := gorm.Open("sqlite3", "tickets.db")
+	if err != nil {
 		return nil, err
 	}
-	if err := db.AutoMigrate(&models.Ticket{}).Error; err != nil {
+	s.db = db
+
+	if err := s.migrate(); err != nil {
 		return nil, err
 	}
 
 	log.Printf("Password hash %s", *adminPassword)
+	http.Handle("/", s.routes())
+
+	return s, nil
+}
+
+func (s *server) routes() http.Handler {
 	auth := auth.NewBasicAuthenticator("localhost:8383", s.secret)
 
 	r := mux.NewRouter()
@@ -92,21 +186,99 @@ func newServer() (*server, error) {
 	api.HandleFunc("/purchaseRequests", auth.Wrap(s.purchaseRequests))
 	api.HandleFunc("/promoCodes", auth.Wrap(s.promoCodes))
 	api.HandleFunc("/tickets", auth.Wrap(s.tickets))
+	api.Methods("POST").Path("/tickets/lookup").HandlerFunc(s.lookupTickets)
+	api.Methods("GET").Path("/tickets/lookup/{token}").HandlerFunc(s.lookedUpTickets)
+	api.Methods("POST", "DELETE").Path("/tickets/{token}/checkin").HandlerFunc(auth.Wrap(s.checkIn))
+	api.HandleFunc("/headcount", auth.Wrap(s.headcount))
 	api.HandleFunc("/square", auth.Wrap(s.square))
 	api.HandleFunc("/stats", auth.Wrap(s.stats))
-	api.HandleFunc("/ticket/{id}", s.ticket)
+	api.HandleFunc("/ticketTypes", auth.Wrap(s.ticketTypes))
+	api.HandleFunc("/priceTiers", auth.Wrap(s.priceTiers))
+	api.Methods("GET").Path("/ticket/{token:[^/]+}.pdf").HandlerFunc(s.ticketPDFDownload)
+	api.Methods("GET").Path("/ticket/{token:[^/]+}.pkpass").HandlerFunc(s.ticketPKPass)
+	api.HandleFunc("/ticket/{token}", s.ticket)
+	api.Methods("GET").Path("/ticket/{token}/googleWallet").HandlerFunc(s.saveToGoogleWallet)
+	api.Methods("POST").Path("/ticket/{token}/transfer").HandlerFunc(s.requestTransfer)
+	api.Methods("GET", "POST").Path("/transfers/{token}").HandlerFunc(s.confirmTransfer)
+	api.Methods("GET").Path("/transfers").HandlerFunc(auth.Wrap(s.transfers))
+	api.Methods("GET").Path("/ticket/{token}/qr.{format:png|svg}").HandlerFunc(s.ticketQRCode)
 	api.HandleFunc("/details", s.details)
+	api.Methods("GET").Path("/waitlist").HandlerFunc(auth.Wrap(s.waitlist))
+	api.Methods("GET", "POST").Path("/waitlist/claim/{token}").HandlerFunc(s.claimWaitlist)
+	api.Methods("GET").Path("/events").HandlerFunc(s.listEvents)
+	api.Methods("POST", "PATCH").Path("/events").HandlerFunc(auth.Wrap(s.saveEvent))
 
 	apiPost := api.Methods("POST").Subrouter()
 	apiPost.HandleFunc("/buy", s.buy)
+	apiPost.HandleFunc("/waitlist", s.joinWaitlist)
 	apiPost.HandleFunc("/buybulk", auth.Wrap(s.buyBulk))
 	apiPost.HandleFunc("/changeEmail", auth.Wrap(s.changeEmail))
+	apiPost.HandleFunc("/resend", auth.Wrap(s.resend))
+	apiPost.HandleFunc("/webhooks/square", s.squareWebhook)
+
+	event := api.PathPrefix("/events/{slug}").Subrouter()
+	event.HandleFunc("/purchaseRequests", auth.Wrap(s.purchaseRequests))
+	event.HandleFunc("/tickets", auth.Wrap(s.tickets))
+	event.Methods("POST", "DELETE").Path("/tickets/{token}/checkin").HandlerFunc(auth.Wrap(s.checkIn))
+	event.HandleFunc("/headcount", auth.Wrap(s.headcount))
+	event.HandleFunc("/stats", auth.Wrap(s.stats))
+	event.HandleFunc("/ticketTypes", auth.Wrap(s.ticketTypes))
+	event.HandleFunc("/priceTiers", auth.Wrap(s.priceTiers))
+	event.HandleFunc("/details", s.details)
+	event.Methods("GET").Path("/waitlist").HandlerFunc(auth.Wrap(s.waitlist))
+	event.Methods("GET").Path("/transfers").HandlerFunc(auth.Wrap(s.transfers))
+
+	eventPost := event.Methods("POST").Subrouter()
+	eventPost.HandleFunc("/buy", s.buy)
+	eventPost.HandleFunc("/waitlist", s.joinWaitlist)
+	eventPost.HandleFunc("/buybulk", auth.Wrap(s.buyBulk))
 
 	r.HandleFunc("/", index)
 	r.PathPrefix("/").Handler(notFoundHook{http.FileServer(http.Dir("./static/"))})
-	http.Handle("/", r)
+	return requestIDs{r}
+}
 
-	return s, nil
+func (s *server) migrate() error {
+	if err := s.db.AutoMigrate(&models.PurchaseRequest{}).Error; err != nil {
+		return err
+	}
+	if err := s.db.AutoMigrate(&models.Attendee{}).Error; err != nil {
+		return err
+	}
+	if err := s.db.AutoMigrate(&models.PromoCode{}).Error; err != nil {
+		return err
+	}
+	if err := s.db.AutoMigrate(&models.Ticket{}).Error; err != nil {
+		return err
+	}
+	if err := s.db.AutoMigrate(&models.Event{}).Error; err != nil {
+		return err
+	}
+	if err := s.db.AutoMigrate(&models.TicketType{}).Error; err != nil {
+		return err
+	}
+	if err := s.db.AutoMigrate(&models.PriceTier{}).Error; err != nil {
+		return err
+	}
+	if err := s.db.AutoMigrate(&models.Reservation{}).Error; err != nil {
+		return err
+	}
+	if err := s.db.AutoMigrate(&models.WaitlistEntry{}).Error; err != nil {
+		return err
+	}
+	if err := s.db.AutoMigrate(&models.TicketTransfer{}).Error; err != nil {
+		return err
+	}
+	if err := s.migrateEvents(); err != nil {
+		return err
+	}
+	if err := s.migrateAttendees(); err != nil {
+		return err
+	}
+	if err := s.migrateTicketTypes(); err != nil {
+		return err
+	}
+	return s.migrateReservations()
 }
 
 type hookedResponseWriter struct {
@@ -165,45 +337,25 @@ func index(w http.ResponseWriter, r *http.Request) {
 
 func (s *server) purchaseRequests(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	w.Header().Set("Content-Type", "application/json")
-	var records []*models.PurchaseRequest
-	if err := s.db.Find(&records).Error; err != nil {
-		s.err(w, err, 500)
-		return
-	}
-	m := make(map[int]*square.Invoice)
-	sq, err := squareLogin()
+	event, err := s.scopedEvent(&r.Request)
 	if err != nil {
-		s.err(w, err, 500)
+		s.eventErr(w, err)
 		return
 	}
-	invoices, err := sq.Invoices()
-	if err != nil {
+	query := s.db
+	if event != nil {
+		query = query.Where("event_id = ?", event.ID)
+	}
+	if state := r.URL.Query().Get("state"); len(state) > 0 {
+		query = query.Where("invoice_state = ?", state)
+	}
+	var records []*models.PurchaseRequest
+	if err := query.Preload("Attendees", orderAttendees).Find(&records).Error; err != nil {
 		s.err(w, err, 500)
 		return
 	}
-	for _, invoice := range invoices {
-		if !strings.HasPrefix(invoice.MerchantInvoiceNumber, PRKey+" ") {
-			continue
-		}
-		bits := strings.Split(invoice.MerchantInvoiceNumber, " ")
-		if len(bits) != 2 {
-			continue
-		}
-		id, err := strconv.Atoi(bits[1])
-		if err != nil {
-			log.Println("invoice parse err", err)
-			continue
-		}
-		m[id] = invoice
-	}
 	for _, pr := range records {
-		invoice, ok := m[pr.ID]
-		if !ok {
-			pr.Status = "NO_INVOICE"
-			continue
-		}
-		pr.Status = invoice.State + " - " + invoice.DeliveryStatus
-		pr.Invoice = invoice
+		pr.Status = pr.InvoiceStatus()
 	}
 
 	if err := json.NewEncoder(w).Encode(records); err != nil {
@@ -215,22 +367,19 @@ func (s *server) purchaseRequests(w http.ResponseWriter, r *auth.AuthenticatedRe
 func (s *server) ticket(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	w.Header().Set("Content-Type", "application/json")
-	var records models.Ticket
-	if err := s.db.Where("id = ?", vars["id"]).Find(&records).Error; err != nil {
-		s.err(w, err, 400)
-		return
-	}
-	if records.ID == "" {
-		s.err(w, fmt.Errorf("ticket %s not found", records.ID), 404)
+	records, err := s.ticketByToken(vars["token"])
+	if err != nil {
+		s.ticketErr(w, err)
 		return
 	}
-	ticket := models.Ticket{
+	ticket := TicketResponse{Ticket: models.Ticket{
 		ID:          records.ID,
 		FirstName:   records.FirstName,
 		LastName:    records.LastName,
 		PhoneNumber: records.PhoneNumber,
 		Email:       records.Email,
-	}
+	}}
+	s.walletLinks(&ticket, vars["token"])
 	if err := json.NewEncoder(w).Encode(ticket); err != nil {
 		s.err(w, err, 500)
 		return
@@ -239,14 +388,10 @@ func (s *server) ticket(w http.ResponseWriter, r *http.Request) {
 
 func (s *server) square(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	w.Header().Set("Content-Type", "application/json")
-	sq, err := squareLogin()
+	invoices, err := s.payments.Invoices()
 	if err != nil {
-		s.err(w, err, 500)
-		return
-	}
-	invoices, err := sq.Invoices()
-	if err != nil {
-		s.err(w, err, 500)
+		status, err := paymentErr(err)
+		s.err(w, err, status)
 		return
 	}
 	if err := json.NewEncoder(w).Encode(invoices); err != nil {
@@ -257,31 +402,53 @@ func (s *server) square(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 
 type Stats struct {
 	Tickets, PurchaseRequests, PeopleCount, AfterPartyCount int
+	// PeopleByType is the PeopleCount broken down by ticket type.
+	PeopleByType map[string]int
 }
 
 func (s *server) stats(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	w.Header().Set("Content-Type", "application/json")
 
-	stats := &Stats{}
+	event, err := s.event(&r.Request)
+	if err != nil {
+		s.eventErr(w, err)
+		return
+	}
+	stats := &Stats{PeopleByType: make(map[string]int)}
 
-	if err := s.db.Model(&models.Ticket{}).Count(&stats.Tickets).Error; err != nil {
+	if err := s.db.Model(&models.Ticket{}).Where("event_id = ?", event.ID).Count(&stats.Tickets).Error; err != nil {
 		s.err(w, err, 500)
 		return
 	}
 
 	var reqs []*models.PurchaseRequest
-	if err := s.db.Model(&models.PurchaseRequest{}).Find(&reqs).Error; err != nil {
+	if err := s.db.Preload("Attendees").Where("event_id = ?", event.ID).Find(&reqs).Error; err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	var types []*models.TicketType
+	if err := s.db.Unscoped().Where("event_id = ?", event.ID).Find(&types).Error; err != nil {
 		s.err(w, err, 500)
 		return
 	}
+	byID := make(map[int]*models.TicketType)
+	byName := make(map[string]*models.TicketType)
+	for _, tt := range types {
+		byID[tt.ID] = tt
+		if tt.DeletedAt == nil {
+			byName[tt.Name] = tt
+		}
+	}
 	stats.PurchaseRequests = len(reqs)
 	for _, req := range reqs {
 		stats.AfterPartyCount += req.AfterPartyCount
-		switch req.Type {
-		case models.Individual:
-			stats.PeopleCount += 1
-		case models.Group:
-			stats.PeopleCount += 4
+		stats.PeopleCount += len(req.Attendees)
+		tt, ok := byID[req.TicketTypeID]
+		if !ok {
+			tt, ok = byName[req.Type]
+		}
+		if ok {
+			stats.PeopleByType[tt.Name] += len(req.Attendees)
 		}
 	}
 	json.NewEncoder(w).Encode(stats)
@@ -289,6 +456,11 @@ func (s *server) stats(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 
 func (s *server) tickets(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 	w.Header().Set("Content-Type", "application/json")
+	event, err := s.scopedEvent(&r.Request)
+	if err != nil {
+		s.eventErr(w, err)
+		return
+	}
 
 	switch r.Method {
 	case "POST":
@@ -298,6 +470,16 @@ func (s *server) tickets(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 			return
 		}
 		req.ID = petname.Generate(3, "-")
+		if event != nil {
+			req.EventID = event.ID
+		} else if req.EventID == 0 {
+			def, err := s.event(&r.Request)
+			if err != nil {
+				s.err(w, err, 500)
+				return
+			}
+			req.EventID = def.ID
+		}
 		if err := s.db.Create(&req).Error; err != nil {
 			s.err(w, err, 500)
 			return
@@ -320,7 +502,7 @@ func (s *server) tickets(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 		}
 		for _, ticket := range req {
 			if err := s.db.Delete(ticket).Error; err != nil {
-				s.err(w, err, 400)
+				s.err(w, err, 500)
 				return
 			}
 		}
@@ -329,11 +511,18 @@ func (s *server) tickets(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 		s.err(w, fmt.Errorf("unknown method %s", r.Method), 400)
 		return
 	}
+	query := s.db
+	if event != nil {
+		query = query.Where("event_id = ?", event.ID)
+	}
 	var records []*models.Ticket
-	if err := s.db.Find(&records).Error; err != nil {
+	if err := query.Find(&records).Error; err != nil {
 		s.err(w, err, 500)
 		return
 	}
+	for _, ticket := range records {
+		ticket.Token = s.signer.sign(ticket)
+	}
 	if err := json.NewEncoder(w).Encode(records); err != nil {
 		s.err(w, err, 500)
 		return
@@ -379,8 +568,10 @@ func (s *server) getPromoCode(code string) (*models.PromoCode, error) {
 	var promoCode *models.PromoCode
 	if code != "" {
 		var pc models.PromoCode
-		if err := s.db.Where("id = ?", code).First(&pc).Error; err != nil {
-			return nil, err
+		if q := s.db.Where("id = ?", code).First(&pc); q.RecordNotFound() {
+			return nil, fieldErrors{{Field: "PromoCode", Code: "invalid", Message: "Invalid promo code: " + code}}
+		} else if q.Error != nil {
+			return nil, errors.Wrap(q.Error, "db promo code")
 		}
 		if pc.Count == 0 {
 			return nil, nil
@@ -390,38 +581,23 @@ func (s *server) getPromoCode(code string) (*models.PromoCode, error) {
 	return promoCode, nil
 }
 
-func (s *server) priceEstimate(req *models.PurchaseRequest) (float64, error) {
-	// No promo codes for groups
-	if req.Type == models.Group {
-		return *priceGroup, nil
-	}
-
-	// Price code
-	basePrice := *priceIndividual
-	if req.Type == models.IndividualCS {
-		basePrice = *priceIndividualCS
-	}
-
-	promoCode, err := s.getPromoCode(req.PromoCode)
-	if err != nil {
-		return 0, err
-	}
-
-	if promoCode != nil {
-		basePrice = basePrice*(1-promoCode.Percent) - promoCode.Amount
-	}
-
-	return basePrice, nil
-}
-
 type DetailsResponse struct {
-	PromoCode *models.PromoCode
-	Price     string
-	Prices    map[string]int
+	Event       EventResponse
+	TicketTypes []TicketTypeResponse
+	PromoCode   *models.PromoCode
+	Price       string
+	Prices      map[string]int
+	// Tier is the current price tier of the requested ticket type, if any.
+	Tier *TierResponse
 }
 
 func (s *server) details(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	event, err := s.event(r)
+	if err != nil {
+		s.eventErr(w, err)
+		return
+	}
 	req := &models.PurchaseRequest{
 		PromoCode: r.FormValue("code"),
 		RawType:   r.FormValue("type"),
@@ -430,82 +606,100 @@ func (s *server) details(w http.ResponseWriter, r *http.Request) {
 		s.err(w, err, 400)
 		return
 	}
-	var promoCode *models.PromoCode
-	if req.Type != models.Group {
-		pc, err := s.getPromoCode(req.PromoCode)
-		if err != nil {
-			s.err(w, err, 400)
-			return
-		}
-		promoCode = pc
+	types, err := s.eventTicketTypes(event)
+	if err != nil {
+		s.err(w, err, 500)
+		return
 	}
-	var price float64
-	var err error
-	price, err = s.priceEstimate(req)
+	ttResps, err := s.ticketTypeResponses(types)
 	if err != nil {
 		s.err(w, err, 500)
 		return
 	}
-	json.NewEncoder(w).Encode(DetailsResponse{
-		PromoCode: promoCode,
-		Price:     fmt.Sprintf("%.2f", price),
-		Prices: map[string]int{
-			models.Group:        int(*priceGroup),
-			models.Individual:   int(*priceIndividual),
-			models.IndividualCS: int(*priceIndividualCS),
+	resp := DetailsResponse{
+		Event: EventResponse{
+			Slug:     event.Slug,
+			Name:     event.Name,
+			Date:     event.Date,
+			Venue:    event.Venue,
+			Capacity: event.Capacity,
 		},
-	})
-}
+		TicketTypes: ttResps,
+		Prices:      make(map[string]int),
+	}
+	for _, tt := range ttResps {
+		resp.Prices[tt.Name] = int(tt.Price)
+	}
 
-func processReq(req *models.PurchaseRequest) error {
-	if len(req.Type) == 0 {
-		switch req.RawType {
-		case models.Group:
-			req.Type = models.Group
-		case models.Individual:
-			req.Type = models.Individual
-		case models.IndividualCS:
-			req.Type = models.IndividualCS
+	// The buyer may not have picked a ticket type yet.
+	if tt, err := s.resolveTicketType(event, req); err == nil {
+		if tt.PromoCodes {
+			pc, err := s.getPromoCode(req.PromoCode)
+			if err != nil {
+				s.err(w, err, validationStatus(err))
+				return
+			}
+			resp.PromoCode = pc
+		}
+		price, err := s.priceEstimate(tt, req)
+		if err != nil {
+			s.err(w, err, 500)
+			return
+		}
+		resp.Price = fmt.Sprintf("%.2f", price)
+		for _, ttResp := range ttResps {
+			if ttResp.Name == tt.Name {
+				resp.Tier = ttResp.Tier
+			}
 		}
 	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func processReq(req *models.PurchaseRequest) error {
 	if len(req.RawAfterPartyCount) > 0 {
 		count, err := strconv.Atoi(req.RawAfterPartyCount)
 		if err != nil {
-			return err
+			return fieldErrors{{Field: "RawAfterPartyCount", Code: "invalid", Message: "After party count must be a number."}}
 		}
 		req.AfterPartyCount = count
 	}
+	prepareAttendees(req)
 	return nil
 }
 
 func (s *server) buy(w http.ResponseWriter, r *http.Request) {
-	var req models.PurchaseRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		s.err(w, err, 400)
+	event, err := s.event(r)
+	if err != nil {
+		s.eventErr(w, err)
 		return
 	}
-	if err := processReq(&req); err != nil {
+	var req models.PurchaseRequest
+	if err := decodePurchaseRequest(r.Body, &req); err != nil {
 		s.err(w, err, 400)
 		return
 	}
-	if err := s.ValidatePurchaseRequest(&req); err != nil {
+	// Buyers only get to fill in the form, not pick which row or invoice.
+	req.ID = 0
+	req.InvoiceToken = ""
+	req.EventID = event.ID
+	if err := processReq(&req); err != nil {
 		s.err(w, err, 400)
 		return
 	}
-
-	price, err := s.priceEstimate(&req)
+	tt, err := s.ValidatePurchaseRequest(event, &req)
 	if err != nil {
-		s.err(w, err, 500)
+		s.err(w, err, validationStatus(err))
 		return
 	}
-	req.Charged = price
 
 	if err := s.createRequestAndInvoice(&req); err != nil {
-		s.err(w, err, 500)
+		status, err := paymentErr(err)
+		s.err(w, err, status)
 		return
 	}
 
-	if req.PromoCode != "" {
+	if req.PromoCode != "" && tt.PromoCodes {
 		promoCode, err := s.getPromoCode(req.PromoCode)
 		if err != nil {
 			s.err(w, err, 500)
@@ -522,8 +716,16 @@ func (s *server) buy(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) buyBulk(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	event, err := s.event(&r.Request)
+	if err != nil {
+		s.eventErr(w, err)
+		return
+	}
 	var req struct {
 		CSV string
+		// Type is the ticket type of rows that don't name one in a fifth
+		// column.
+		Type string
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		s.err(w, err, 400)
@@ -539,9 +741,17 @@ func (s *server) buyBulk(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 		return
 	}
 	var reqs []models.PurchaseRequest
-	for _, rec := range records {
-		if len(rec) != 4 {
-			s.err(w, errors.Errorf("need fields 4 records, got %d", len(rec)), 400)
+	for i, rec := range records {
+		if len(rec) != 4 && len(rec) != 5 {
+			s.err(w, errors.Errorf("need 4 or 5 fields in record %d, got %d", i+1, len(rec)), 400)
+			return
+		}
+		ticketType := strings.TrimSpace(req.Type)
+		if len(rec) == 5 && strings.TrimSpace(rec[4]) != "" {
+			ticketType = strings.TrimSpace(rec[4])
+		}
+		if ticketType == "" {
+			s.err(w, errors.Errorf("record %d doesn't have a ticket type and no default Type was given", i+1), 400)
 			return
 		}
 		parts := strings.Split(rec[0], " ")
@@ -553,23 +763,17 @@ func (s *server) buyBulk(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 			StudentID:   rec[1],
 			Email:       rec[2],
 			PhoneNumber: rec[3],
-			RawType:     "IndividualCS",
+			RawType:     ticketType,
+			EventID:     event.ID,
 		}
 		if err := processReq(&req); err != nil {
 			s.err(w, err, 400)
 			return
 		}
-		if err := s.ValidatePurchaseRequest(&req); err != nil {
-			s.err(w, err, 400)
-			return
-		}
-
-		price, err := s.priceEstimate(&req)
-		if err != nil {
-			s.err(w, err, 500)
+		if _, err := s.ValidatePurchaseRequest(event, &req); err != nil {
+			s.err(w, err, validationStatus(err))
 			return
 		}
-		req.Charged = price
 		reqs = append(reqs, req)
 	}
 
@@ -577,22 +781,69 @@ func (s *server) buyBulk(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 
 	for _, req := range reqs {
 		if err := s.createRequestAndInvoice(&req); err != nil {
-			s.err(w, err, 500)
+			status, err := paymentErr(err)
+			s.err(w, err, status)
 			return
 		}
 	}
 }
 
+// createRequestAndInvoice saves req and reserves its seats if it hasn't been
+// already, then invoices it. It is safe to call again on the same request
+// after an error.
 func (s *server) createRequestAndInvoice(req *models.PurchaseRequest) error {
-	if err := s.db.Create(req).Error; err != nil {
-		return err
+	saved := s.db.NewRecord(req)
+	if saved {
+		if err := s.createAndReserve(req, nil); err != nil {
+			return err
+		}
 	}
-	if err := SendInvoice(req); err != nil {
+	if err := s.sendInvoice(req, !saved); err != nil {
+		// Unless Square may have created the invoice anyway, the buyer is
+		// told it failed and may well buy again, so don't retry it later.
+		if !mayHaveInvoiced(err) {
+			s.failInvoice(req, err)
+		}
 		return err
 	}
 	return nil
 }
 
+// invoiceCreateError is an error from asking Square to create an invoice, as
+// opposed to from looking for an existing one first.
+type invoiceCreateError struct {
+	err error
+}
+
+func (e *invoiceCreateError) Error() string { return e.err.Error() }
+func (e *invoiceCreateError) Unwrap() error { return e.err }
+
+// mayHaveInvoiced reports whether err from SendInvoice leaves it unknown
+// whether Square created the invoice, because the create request was sent but
+// no response came back. Those are the only failures resendInvoices retries.
+func mayHaveInvoiced(err error) bool {
+	var create *invoiceCreateError
+	var transport *square.TransportError
+	return errors.As(err, &create) && errors.As(create.err, &transport)
+}
+
+// failInvoice records that invoicing pr failed for good and stops holding its
+// seats.
+func (s *server) failInvoice(pr *models.PurchaseRequest, err error) {
+	t := now()
+	if dbErr := s.db.Model(pr).UpdateColumns(map[string]interface{}{
+		"invoice_failed_at": t,
+		"invoice_error":     err.Error(),
+	}).Error; dbErr != nil {
+		log.Printf("record invoice failure %d err %s", pr.ID, dbErr)
+	}
+	pr.InvoiceFailedAt = &t
+	pr.InvoiceError = err.Error()
+	if err := releaseSeats(s.db, pr.ID, "invoice failed"); err != nil {
+		log.Println("release seats err", err)
+	}
+}
+
 type changeEmailRequest struct {
 	PurchaseRequestID string
 	NewEmail          string
@@ -617,61 +868,103 @@ func (s *server) changeEmail(w http.ResponseWriter, r *auth.AuthenticatedRequest
 	}
 
 	var pr models.PurchaseRequest
-	if err := s.db.Find(&pr, id).Error; err != nil {
-		s.err(w, err, 400)
+	if q := s.db.Preload("Attendees", orderAttendees).Find(&pr, id); q.RecordNotFound() {
+		s.err(w, errors.Errorf("unknown purchase request %d", id), 404)
 		return
+	} else if q.Error != nil {
+		s.err(w, q.Error, 500)
+		return
+	}
+	for i, a := range pr.Attendees {
+		if a.Email == pr.Email {
+			pr.Attendees[i].Email = req.NewEmail
+		}
 	}
 	pr.Email = req.NewEmail
 	pr.ID = 0
+	pr.InvoiceToken = ""
 
 	if err := s.createRequestAndInvoice(&pr); err != nil {
-		s.err(w, err, 500)
+		status, err := paymentErr(err)
+		s.err(w, err, status)
 		return
 	}
 }
 
-type err struct {
-	Error string
+// paymentErr turns an error from creating a purchase request and its invoice
+// into the status and error shown to the buyer. Square outages become a 503
+// with a generic message.
+func paymentErr(err error) (int, error) {
+	var seats *seatsError
+	var validation *square.ValidationError
+	switch {
+	case errors.As(err, &seats):
+		return 400, seats.error
+	case mayHaveInvoiced(err):
+		log.Println("square create invoice lost", err)
+		return 503, withCode("invoice_pending", errors.New("We couldn't confirm your invoice with Square. We'll keep trying and email it to you, so please don't buy again."))
+	case errors.As(err, &validation):
+		return 400, withCode("invoice_rejected", errors.Errorf("Square couldn't create your invoice: %s", validation.ErrorMessage))
+	case paymentsUnavailable(err):
+		log.Println("square unavailable", err)
+		return 503, withCode("payments_unavailable", errors.New("Our payment provider is unavailable right now, please try again in a few minutes."))
+	}
+	return 500, err
 }
 
-func (s *server) err(w http.ResponseWriter, sendErr error, status int) {
-	body, err := json.Marshal(err{sendErr.Error()})
+// paymentsUnavailable reports whether err means Square couldn't be reached or
+// wouldn't serve us, rather than that it refused the request.
+func paymentsUnavailable(err error) bool {
+	var rateLimit *square.RateLimitError
+	var transport *square.TransportError
+	var auth *square.AuthError
+	return errors.As(err, &rateLimit) || errors.As(err, &transport) || errors.As(err, &auth)
+}
+
+// ValidatePurchaseRequest checks pr against its ticket type and the seats
+// left, returning the ticket type.
+func (s *server) ValidatePurchaseRequest(event *models.Event, pr *models.PurchaseRequest) (*models.TicketType, error) {
+	tt, err := s.validateRequest(event, pr)
 	if err != nil {
-		http.Error(w, sendErr.Error(), status)
-		return
+		return nil, err
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	w.Write(body)
+	if err := checkSeats(s.db, event, tt); err != nil {
+		return nil, err
+	}
+	return tt, nil
 }
 
-func (s *server) ValidatePurchaseRequest(pr *models.PurchaseRequest) error {
-	needed := 1
-	if pr.Type == models.Group {
-		needed = 4
+// validateRequest checks everything ValidatePurchaseRequest does except
+// whether there are seats left.
+func (s *server) validateRequest(event *models.Event, pr *models.PurchaseRequest) (*models.TicketType, error) {
+	tt, err := s.resolveTicketType(event, pr)
+	if err != nil {
+		return nil, err
 	}
-	count := 0
-	if err := s.db.Model(&models.Ticket{}).Count(&count).Error; err != nil {
-		return err
+	if err := tt.Eligible(pr); err != nil {
+		return nil, withCode("ineligible", err)
 	}
-	if count+needed > *maxTickets {
-		return fmt.Errorf("Sorry, there are %d tickets available. This event may be sold out, or you need to check back later.", *maxTickets-count)
+	if err := checkAttendees(tt, pr); err != nil {
+		return nil, err
+	}
+	if err := s.validateAttendees(event, pr); err != nil {
+		return nil, err
 	}
 
 	promoCode, err := s.getPromoCode(pr.PromoCode)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if pr.PromoCode != "" && promoCode == nil {
-		return fmt.Errorf("Invalid promo code: %s", pr.PromoCode)
+		return nil, fieldErrors{{Field: "PromoCode", Code: "invalid", Message: "Invalid promo code: " + pr.PromoCode}}
 	}
 	if _, err := govalidator.ValidateStruct(pr); err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return tt, nil
 }
 
-func (s server) secret(user, realm string) string {
+func (s *server) secret(user, realm string) string {
 	if user == "admin" {
 		return *adminPassword
 	}
@@ -691,7 +984,48 @@ func newTicket(first, last, phone, email string, purchaseRequestID int) models.T
 	}
 }
 
-func SendInvoice(pr *models.PurchaseRequest) error {
+// SendInvoice creates the Square invoice for pr and records its token. If pr
+// has already been invoiced, including by an earlier attempt whose response
+// was lost, the existing invoice is reused instead.
+func (s *server) SendInvoice(pr *models.PurchaseRequest) error {
+	return s.sendInvoice(pr, true)
+}
+
+// sendInvoice is SendInvoice, but only looks for an existing invoice if
+// search is set. Requests saved by the caller can't have one yet.
+func (s *server) sendInvoice(pr *models.PurchaseRequest, search bool) error {
+	if len(pr.InvoiceToken) > 0 {
+		return nil
+	}
+	event, err := s.eventByID(pr.EventID)
+	if err != nil {
+		return err
+	}
+	var invoice *square.Invoice
+	if search {
+		// Square lists invoices newest first, so only look back as far as
+		// when the request was made.
+		var after time.Time
+		if !pr.CreatedAt.IsZero() {
+			after = pr.CreatedAt.Add(-square.InvoiceSearchSlack)
+		}
+		if invoice, err = s.payments.InvoiceByReference(event.InvoiceReference(pr.ID), after); err != nil {
+			return err
+		}
+	}
+	if invoice == nil {
+		if invoice, err = s.payments.CreateInvoice(invoiceRequest(event, pr)); err != nil {
+			return &invoiceCreateError{err}
+		}
+		log.Printf("invoice %+v", invoice)
+	} else {
+		log.Printf("purchase request %d already has invoice %s", pr.ID, invoice.Token)
+	}
+	return s.recordInvoice(pr, invoice)
+}
+
+// invoiceRequest builds the Square invoice for a purchase request.
+func invoiceRequest(event *models.Event, pr *models.PurchaseRequest) *square.InvoiceCreateRequest {
 	amt := &square.Money{
 		Amount:       int(pr.Charged * 100),
 		CurrencyCode: *currency,
@@ -700,7 +1034,7 @@ func SendInvoice(pr *models.PurchaseRequest) error {
 		Amount:       0,
 		CurrencyCode: *currency,
 	}
-	req := &square.InvoiceCreateRequest{
+	return &square.InvoiceCreateRequest{
 		AdditionalRecipientEmail: make([]struct{}, 0),
 		Cart: &square.Cart{
 			Amounts: &square.Amounts{
@@ -717,8 +1051,8 @@ func SendInvoice(pr *models.PurchaseRequest) error {
 							GrossSalesMoney:                      amt,
 							ItemVariationPriceMoney:              amt,
 							ItemVariationPriceTimesQuantityMoney: amt,
-							TaxMoney:   none,
-							TotalMoney: amt,
+							TaxMoney:                             none,
+							TotalMoney:                           amt,
 						},
 						Configuration: &square.Configuration{
 							BackingType:             "CUSTOM_AMOUNT",
@@ -728,7 +1062,7 @@ func SendInvoice(pr *models.PurchaseRequest) error {
 								Fee:      make([]struct{}, 0),
 							},
 						},
-						CustomNote: "CSSS Year End Gala Ticket - " + pr.RawType,
+						CustomNote: event.Name + " Ticket - " + pr.RawType,
 						Quantity:   "1",
 					},
 				},
@@ -736,151 +1070,293 @@ func SendInvoice(pr *models.PurchaseRequest) error {
 				Fee:      make([]struct{}, 0),
 			},
 		},
-		DueOn:                 square.DueDate{}.FromTime(time.Now().Add(24 * time.Hour)),
-		InvoiceName:           "CSSS Year End Gala Tickets",
+		DueOn:                 square.DueDate{}.FromTime(now().Add(24 * time.Hour)),
+		InvoiceName:           event.Name + " Tickets",
 		IsDraft:               false,
-		MerchantInvoiceNumber: fmt.Sprintf("%s %d", PRKey, pr.ID),
+		MerchantInvoiceNumber: event.InvoiceReference(pr.ID),
 		Payer: &square.Payer{
 			DisplayName: pr.FirstName + " " + pr.LastName,
 			Email:       pr.Email,
 		},
 		RequestedMoney: amt,
 	}
-	sq, err := squareLogin()
-	if err != nil {
-		return err
+}
+
+// pollSquare periodically checks every invoice. With webhooks enabled it only
+// runs as a slow reconciliation fallback.
+func (s *server) pollSquare() {
+	interval := *pollInterval
+	if len(*squareWebhookKey) > 0 {
+		interval = *reconcileInterval
 	}
-	invoice, err := sq.CreateInvoice(req)
-	if err != nil {
-		return err
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.checkInvoices()
 	}
-	log.Printf("invoice %+v", invoice)
-	return nil
 }
 
-const loginTime = 7 * 24 * time.Hour
-
-var (
-	client       *square.Client
-	clientUpdate time.Time
-	clientMu     sync.Mutex
-)
-
-func squareLogin() (*square.Client, error) {
-	clientMu.Lock()
-	defer clientMu.Unlock()
+// checkInvoices fetches every invoice from the payment provider and processes
+// the ones that belong to purchase requests.
+func (s *server) checkInvoices() {
+	invoices, err := s.payments.Invoices()
+	if err != nil {
+		log.Println("square err", err)
+		return
+	}
+	log.Printf("invoices %d", len(invoices))
+	for _, invoice := range invoices {
+		if err := s.processInvoice(invoice); err != nil {
+			log.Println("process invoice err", err)
+		}
+	}
+	s.resendInvoices()
+	s.releaseAbandoned()
+	s.expireClaims()
+	s.inviteWaitlists()
+}
 
-	if clientUpdate.Before(time.Now().Add(-loginTime)) || client == nil {
-		var err error
-		if len(*squareCookies) > 0 {
-			client, err = square.NewCookies(*squareCookies)
-		} else {
-			client, err = square.New(*squareEmail, *squarePass)
+// resendInvoices retries invoicing purchase requests whose create request may
+// have reached Square without a response. Requests younger than a minute are
+// skipped so this doesn't race with the buy handler that created them.
+func (s *server) resendInvoices() {
+	var prs []models.PurchaseRequest
+	t := now()
+	if err := s.db.Where(
+		"invoice_token = ? AND invoice_failed_at IS NULL AND created_at BETWEEN ? AND ?",
+		"", t.Add(-24*time.Hour), t.Add(-time.Minute),
+	).Find(&prs).Error; err != nil {
+		log.Println("resend invoices err", err)
+		return
+	}
+	for i := range prs {
+		// The seats may have been released since, and an invoice shouldn't go
+		// out without them.
+		if err := s.holdSeats(&prs[i]); err != nil {
+			log.Printf("resend invoice %d err %s", prs[i].ID, err)
+			var seats *seatsError
+			if errors.As(err, &seats) {
+				s.failInvoice(&prs[i], err)
+			}
+			continue
 		}
-		if err != nil {
-			return nil, err
+		if err := s.SendInvoice(&prs[i]); err != nil {
+			log.Printf("resend invoice %d err %s", prs[i].ID, err)
+			// Square may still have the invoice while it's unreachable, so
+			// only give up when it answers.
+			if !paymentsUnavailable(err) {
+				s.failInvoice(&prs[i], err)
+			}
 		}
-		clientUpdate = time.Now()
 	}
-
-	return client, nil
 }
 
-func (s *server) pollSquare() {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
-	for range ticker.C {
-		sq, err := squareLogin()
+// processInvoice issues tickets for a paid invoice and cancels an unpaid one
+// once it is more than a day old. Invoices that are partly or pending payment
+// are left alone.
+func (s *server) processInvoice(invoice *square.Invoice) error {
+	prefix, id, ok := parseInvoiceReference(invoice.MerchantInvoiceNumber)
+	if !ok {
+		return nil
+	}
+	var event models.Event
+	if q := s.db.Where("invoice_prefix = ?", prefix).First(&event); q.RecordNotFound() {
+		return nil
+	} else if q.Error != nil {
+		return errors.Wrap(q.Error, "db event")
+	}
+	s.invoiceMu.Lock()
+	defer s.invoiceMu.Unlock()
+
+	var pr models.PurchaseRequest
+	query := s.db.Where("event_id = ?", event.ID).Find(&pr, id)
+	if query.RecordNotFound() {
+		log.Printf("no purchase request for invoice %q", invoice.MerchantInvoiceNumber)
+		return nil
+	} else if err := query.Error; err != nil {
+		return errors.Wrap(err, "db")
+	}
+	if staleInvoice(&pr, invoice) {
+		log.Printf("ignoring out of date %s invoice %q", invoice.State, invoice.MerchantInvoiceNumber)
+		return nil
+	}
+	previous := pr.InvoiceState
+	if err := s.recordInvoice(&pr, invoice); err != nil {
+		return err
+	}
+	if err := query.Association("Tickets").Find(&pr.Tickets).Error; err != nil {
+		return errors.Wrap(err, "db tickets")
+	}
+	if len(pr.Tickets) != 0 {
+		return nil
+	}
+	switch invoice.State {
+	case "PAID":
+		log.Printf("Found paid invoice %+v %+v", invoice, pr)
+		attendees, err := s.attendees(&pr)
 		if err != nil {
-			log.Println("square err", err)
-			continue
+			return err
 		}
-		invoices, err := sq.Invoices()
-		if err != nil {
-			log.Println("square err", err)
-			continue
+		var tickets []models.Ticket
+		for _, a := range attendees {
+			tickets = append(tickets, newTicket(a.FirstName, a.LastName, a.PhoneNumber, a.Email, id))
 		}
-		log.Printf("invoices %d", len(invoices))
-		for _, invoice := range invoices {
-			if !strings.HasPrefix(invoice.MerchantInvoiceNumber, PRKey+" ") {
-				continue
-			}
-			bits := strings.Split(invoice.MerchantInvoiceNumber, " ")
-			if len(bits) != 2 {
-				continue
+		tx := s.db.Begin()
+		for i := range tickets {
+			tickets[i].EventID = event.ID
+			if err := tx.Create(&tickets[i]).Error; err != nil {
+				tx.Rollback()
+				return errors.Wrap(err, "db")
 			}
-			id, err := strconv.Atoi(bits[1])
-			if err != nil {
-				log.Println("invoice parse err", err)
-				continue
-			}
-			var pr models.PurchaseRequest
-			query := s.db.Find(&pr, id)
-			if err := query.Error; err != nil {
-				log.Println("db err", err)
-				continue
-			}
-			if err := query.Association("Tickets").Find(&pr.Tickets).Error; err != nil {
-				log.Println("db tickets err", err)
-				continue
-			}
-			if len(pr.Tickets) != 0 {
-				continue
-			}
-			if invoice.State == "PAID" {
-				log.Printf("Found paid invoice %+v %+v", invoice, pr)
-				var tickets []models.Ticket
-				tickets = append(tickets, newTicket(pr.FirstName, pr.LastName, pr.PhoneNumber, pr.Email, id))
-
-				if pr.Type == models.Group {
-					tickets = append(tickets, newTicket(pr.GroupMember2FirstName,
-						pr.GroupMember2LastName, pr.GroupMember2PhoneNumber, pr.GroupMember2Email, id))
-					tickets = append(tickets, newTicket(pr.GroupMember3FirstName,
-						pr.GroupMember3LastName, pr.GroupMember3PhoneNumber, pr.GroupMember3Email, id))
-					tickets = append(tickets, newTicket(pr.GroupMember4FirstName,
-						pr.GroupMember4LastName, pr.GroupMember4PhoneNumber, pr.GroupMember4Email, id))
-				}
-				for _, ticket := range tickets {
-					if err := s.db.Create(&ticket).Error; err != nil {
-						log.Println("db err", err)
-						return
-					}
-				}
-				/*
-					if err := s.db.First(&pr, id).Update("Tickets", tickets).Error; err != nil {
-						log.Println("db err", err)
-						continue
-					}
-				*/
-				for i, ticket := range tickets {
-					body := `<p>Hey ` + ticket.FirstName + `,</p>
-					<p>Here's your tickets for the CSSS Year End Gala:</p>
-					<p>`
-					body += ticket.HTML()
-
-					if i == 0 {
-						for _, ticket := range tickets[1:] {
-							body += ticket.HTML()
-						}
-					}
-					body += `</p><p>See you at the gala!<br>The CSSS</p>`
-					if err := email.SendEmail(ticket.Email, "CSSS Year End Gala Tickets", body); err != nil {
-						log.Println("send email err", err)
-					}
-				}
-			} else if invoice.State == "UNPAID" {
-				if time.Now().Add(-24 * time.Hour).Before(pr.CreatedAt) {
-					continue
-				}
-				log.Printf("old and needs to be removed %+v", invoice)
-				_, err := sq.CancelInvoice(&square.InvoiceCancelRequest{
-					Token: invoice.Token,
-					SendEmailToRecipients: false,
-				})
-				if err != nil {
-					log.Println("square invoice cancel err", err)
-				}
+		}
+		if err := releaseSeats(tx, pr.ID, "tickets issued"); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return errors.Wrap(err, "db commit")
+		}
+		if err := s.emailTickets(&event, tickets); err != nil {
+			log.Println("send email err", err)
+		}
+	case "UNPAID":
+		if now().Add(-24 * time.Hour).Before(pr.CreatedAt) {
+			return nil
+		}
+		log.Printf("old and needs to be removed %+v", invoice)
+		canceled, err := s.payments.CancelInvoice(&square.InvoiceCancelRequest{
+			Token:                 invoice.Token,
+			SendEmailToRecipients: false,
+		})
+		if err != nil {
+			return errors.Wrap(err, "square invoice cancel")
+		}
+		if canceled != nil {
+			return s.recordInvoice(&pr, canceled)
+		}
+	case "PAYMENT_PENDING", "PARTIALLY_PAID", "SCHEDULED":
+		// The buyer has started paying, or Square hasn't sent the invoice
+		// yet, so it isn't canceled however old it is. A partial payment
+		// needs an admin to sort out, since tickets are only issued once
+		// it's paid in full.
+		if previous != invoice.State {
+			log.Printf("invoice %q is %s, holding its seats", invoice.MerchantInvoiceNumber, invoice.State)
+		}
+	}
+	return nil
+}
+
+// emailTickets emails each holder their ticket. The first holder, who bought
+// them, also gets everyone else's. Every email is tried and the last error is
+// returned.
+func (s *server) emailTickets(event *models.Event, tickets []models.Ticket) error {
+	links := make([]string, len(tickets))
+	files := make([][]email.File, len(tickets))
+	for i := range tickets {
+		links[i], files[i] = s.ticketEmailHTML(&tickets[i])
+	}
+	var sendErr error
+	for i, ticket := range tickets {
+		body := `<p>Hey ` + ticket.FirstName + `,</p>
+		<p>` + event.EmailIntro + `</p>
+		<p>`
+		body += links[i]
+		attached := files[i]
+
+		if i == 0 {
+			for j := range tickets[1:] {
+				body += links[j+1]
+				attached = append(attached, files[j+1]...)
 			}
 		}
+		body += `</p><p>` + event.EmailSignoff + `</p>`
+		if err := sendEmail(ticket.Email, event.Name+" Tickets", body, attached...); err != nil {
+			sendErr = errors.Wrapf(err, "email ticket %s to %s", ticket.ID, ticket.Email)
+		}
+	}
+	return sendErr
+}
+
+// ticketEmailHTML returns the link to a ticket for an email, followed by its
+// QR code as an inline image so it shows without loading the site, and a
+// printable PDF to attach. If those can't be made the email just has the link.
+func (s *server) ticketEmailHTML(ticket *models.Ticket) (string, []email.File) {
+	token := s.signer.sign(ticket)
+	html := ticket.HTML(token)
+	var files []email.File
+	qr, err := ticketQR(ticket, token)
+	if err != nil {
+		log.Printf("ticket %s: %s", ticket.ID, err)
+		return html, nil
+	}
+	png, err := qr.PNG(defaultQRSize)
+	if err != nil {
+		log.Printf("ticket %s: qr png: %s", ticket.ID, err)
+	} else {
+		name := "ticket-" + ticket.ID + ".png"
+		html += `<img src="cid:` + name + `" alt="QR code for ` + ticket.FirstName + ` ` + ticket.LastName +
+			`'s ticket" width="200" height="200"><br>`
+		files = append(files, email.File{Name: name, Data: png, Inline: true})
+	}
+	pdf, err := s.ticketPDF(ticket, token)
+	if err != nil {
+		log.Printf("ticket %s: %s", ticket.ID, err)
+	} else {
+		files = append(files, email.File{Name: ticketPDFName(ticket), Data: pdf})
 	}
+	return html, files
+}
+
+// staleInvoice reports whether invoice is older than what was last recorded on
+// pr, as happens when webhooks or polls arrive out of order.
+func staleInvoice(pr *models.PurchaseRequest, invoice *square.Invoice) bool {
+	// Paid invoices never become unpaid again, whatever the timestamps say.
+	if pr.PaidAt != nil && invoice.State == "UNPAID" {
+		return true
+	}
+	if pr.InvoiceUpdatedAt == nil || invoice.UpdatedAt == nil {
+		return false
+	}
+	return invoice.UpdatedAt.Time().Before(*pr.InvoiceUpdatedAt)
+}
+
+// recordInvoice copies the Square invoice's token and state onto pr, saving
+// any changes. Out of date invoices are ignored.
+func (s *server) recordInvoice(pr *models.PurchaseRequest, invoice *square.Invoice) error {
+	if staleInvoice(pr, invoice) {
+		return nil
+	}
+	updates := make(map[string]interface{})
+	if pr.InvoiceToken != invoice.Token {
+		updates["invoice_token"] = invoice.Token
+	}
+	if pr.InvoiceState != invoice.State {
+		updates["invoice_state"] = invoice.State
+	}
+	if pr.DeliveryStatus != invoice.DeliveryStatus {
+		updates["delivery_status"] = invoice.DeliveryStatus
+	}
+	changed := now()
+	if invoice.UpdatedAt != nil {
+		changed = invoice.UpdatedAt.Time()
+		if pr.InvoiceUpdatedAt == nil || !pr.InvoiceUpdatedAt.Equal(changed) {
+			updates["invoice_updated_at"] = changed
+		}
+	}
+	if invoice.State == "PAID" && pr.PaidAt == nil {
+		updates["paid_at"] = changed
+	}
+	if invoice.State == "CANCELED" && pr.CanceledAt == nil {
+		updates["canceled_at"] = changed
+		if err := releaseSeats(s.db, pr.ID, "invoice canceled"); err != nil {
+			return err
+		}
+	}
+	if len(updates) == 0 {
+		return nil
+	}
+	if err := s.db.Model(pr).UpdateColumns(updates).Error; err != nil {
+		return errors.Wrap(err, "db invoice state")
+	}
+	return nil
 }
@@ -0,0 +1,2269 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/email"
+	"github.com/ubccsss/square-invoice-tickets/models"
+	"github.com/ubccsss/square-invoice-tickets/square"
+	"github.com/ubccsss/square-invoice-tickets/square/squaretest"
+	"go.mozilla.org/pkcs7"
+)
+
+type fakeProvider struct {
+	mu sync.Mutex
+
+	invoices    []*square.Invoice
+	invoicesErr error
+	canceled    []string
+
+	// loseCreate makes the next CreateInvoice create the invoice but report
+	// an error, as if the response never arrived.
+	loseCreate bool
+	// createErr, if set, is returned by the next CreateInvoice without
+	// creating anything.
+	createErr error
+	// searches are the cutoffs InvoiceByReference was called with.
+	searches []time.Time
+}
+
+func (f *fakeProvider) Invoices() ([]*square.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*square.Invoice(nil), f.invoices...), f.invoicesErr
+}
+
+func (f *fakeProvider) CreateInvoice(req *square.InvoiceCreateRequest) (*square.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.createErr; err != nil {
+		f.createErr = nil
+		return nil, err
+	}
+	invoice := &square.Invoice{
+		MerchantInvoiceNumber: req.MerchantInvoiceNumber,
+		State:                 "UNPAID",
+		Token:                 req.MerchantInvoiceNumber,
+		RequestedMoney:        req.RequestedMoney,
+	}
+	f.invoices = append(f.invoices, invoice)
+	if f.loseCreate {
+		f.loseCreate = false
+		return nil, &square.TransportError{Err: errors.New("connection reset")}
+	}
+	return invoice, nil
+}
+
+func (f *fakeProvider) CancelInvoice(req *square.InvoiceCancelRequest) (*square.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.canceled = append(f.canceled, req.Token)
+	for _, invoice := range f.invoices {
+		if invoice.Token == req.Token {
+			invoice.State = "CANCELED"
+			return invoice, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeProvider) InvoiceByReference(ref string, after time.Time) (*square.Invoice, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.searches = append(f.searches, after)
+	for _, invoice := range f.invoices {
+		if invoice.MerchantInvoiceNumber == ref {
+			return invoice, nil
+		}
+	}
+	return nil, nil
+}
+
+func newTestServer(t *testing.T) (*server, *fakeProvider, func()) {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to :memory: is a separate database.
+	db.DB().SetMaxOpenConns(1)
+	payments := &fakeProvider{}
+	s := &server{
+		db:             db,
+		payments:       payments,
+		signer:         &ticketSigner{keys: []ticketKey{{ID: "test", Secret: []byte("secret")}}},
+		lookupsByIP:    newRateLimiter(5, time.Hour),
+		lookupsByEmail: newRateLimiter(5, time.Hour),
+		joinsByIP:      newRateLimiter(5, time.Hour),
+		joinsByEmail:   newRateLimiter(5, time.Hour),
+
+		transfersByTicket: newRateLimiter(3, time.Hour),
+		transfersByIP:     newRateLimiter(3, time.Hour),
+	}
+	if err := s.migrate(); err != nil {
+		t.Fatal(err)
+	}
+
+	sent := sendEmail
+	sendEmail = func(to, subj, body string, files ...email.File) error { return nil }
+	return s, payments, func() {
+		sendEmail = sent
+		db.Close()
+	}
+}
+
+// testEvent returns the default event created by migrate.
+func testEvent(t *testing.T, s *server) *models.Event {
+	event, err := s.event(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func TestCheckInvoicesIssuesTickets(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	pr := models.PurchaseRequest{
+		EventID:   testEvent(t, s).ID,
+		FirstName: "first",
+		LastName:  "last",
+		Email:     "a@example.com",
+		Type:      models.Individual,
+		Charged:   35,
+	}
+	if err := s.createRequestAndInvoice(&pr); err != nil {
+		t.Fatal(err)
+	}
+	if len(payments.invoices) != 1 {
+		t.Fatalf("invoices = %d; not 1", len(payments.invoices))
+	}
+
+	s.checkInvoices()
+	var count int
+	s.db.Model(&models.Ticket{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("unpaid invoice issued %d tickets", count)
+	}
+
+	payments.invoices[0].State = "PAID"
+	s.checkInvoices()
+	s.checkInvoices()
+	s.db.Model(&models.Ticket{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("paid invoice issued %d tickets; not 1", count)
+	}
+
+	var saved models.PurchaseRequest
+	if err := s.db.Find(&saved, pr.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if saved.InvoiceState != "PAID" || saved.PaidAt == nil {
+		t.Errorf("InvoiceState = %q, PaidAt = %v; want PAID with a time", saved.InvoiceState, saved.PaidAt)
+	}
+}
+
+func TestPurchaseRequestsFromDB(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, name := range []string{"paid", "unpaid"} {
+		pr := models.PurchaseRequest{EventID: testEvent(t, s).ID, FirstName: name, Type: models.Individual}
+		if err := s.createRequestAndInvoice(&pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	payments.invoices[0].State = "PAID"
+	payments.invoices[0].DeliveryStatus = "DELIVERED"
+	s.checkInvoices()
+
+	payments.invoicesErr = &square.TransportError{Err: errors.New("down")}
+	req := httptest.NewRequest("GET", "/api/purchaseRequests?state=PAID", nil)
+	w := httptest.NewRecorder()
+	s.purchaseRequests(w, &auth.AuthenticatedRequest{Request: *req})
+	if w.Code != 200 {
+		t.Fatalf("status = %d; body %s", w.Code, w.Body)
+	}
+	var records []models.PurchaseRequest
+	if err := json.NewDecoder(w.Body).Decode(&records); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].FirstName != "paid" {
+		t.Fatalf("records = %+v; want just the paid request", records)
+	}
+	if records[0].Status != "PAID - DELIVERED" {
+		t.Errorf("Status = %q", records[0].Status)
+	}
+}
+
+func TestCreateRequestAndInvoiceRetry(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	payments.loseCreate = true
+	pr := models.PurchaseRequest{EventID: testEvent(t, s).ID, FirstName: "first", Email: "a@example.com", Type: models.Individual}
+	if err := s.createRequestAndInvoice(&pr); err == nil {
+		t.Fatal("expected lost create to fail")
+	}
+	// A request saved just now can't have an invoice to look for yet.
+	if len(payments.searches) != 0 {
+		t.Errorf("searched for an invoice of a new request")
+	}
+	if err := s.createRequestAndInvoice(&pr); err != nil {
+		t.Fatal(err)
+	}
+	if len(payments.invoices) != 1 {
+		t.Fatalf("invoices = %d; not 1", len(payments.invoices))
+	}
+	if len(payments.searches) != 1 || !payments.searches[0].Equal(pr.CreatedAt.Add(-square.InvoiceSearchSlack)) {
+		t.Errorf("searches = %v; want one back to %s", payments.searches, pr.CreatedAt.Add(-square.InvoiceSearchSlack))
+	}
+
+	var saved models.PurchaseRequest
+	if err := s.db.Find(&saved, pr.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if saved.InvoiceToken != payments.invoices[0].Token {
+		t.Errorf("InvoiceToken = %q; not %q", saved.InvoiceToken, payments.invoices[0].Token)
+	}
+	var count int
+	s.db.Model(&models.PurchaseRequest{}).Count(&count)
+	if count != 1 {
+		t.Errorf("purchase requests = %d; not 1", count)
+	}
+}
+
+func TestResendInvoices(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	payments.loseCreate = true
+	pr := models.PurchaseRequest{EventID: testEvent(t, s).ID, FirstName: "first", Email: "a@example.com", Type: models.Individual}
+	s.createRequestAndInvoice(&pr)
+	payments.invoices = nil
+
+	s.resendInvoices()
+	if len(payments.invoices) != 0 {
+		t.Fatal("resent an invoice for a brand new request")
+	}
+
+	s.db.Model(&pr).UpdateColumn("created_at", time.Now().Add(-2*time.Minute))
+	s.resendInvoices()
+	s.resendInvoices()
+	if len(payments.invoices) != 1 {
+		t.Fatalf("invoices = %d; not 1", len(payments.invoices))
+	}
+}
+
+func TestFailedInvoicesNotResent(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	event := testEvent(t, s)
+	for _, err := range []error{
+		&square.ValidationError{ErrorMessage: "bad email"},
+		&square.RateLimitError{},
+	} {
+		payments.createErr = err
+		pr := models.PurchaseRequest{EventID: event.ID, FirstName: "first", Email: "a@example.com", Type: models.Individual}
+		if err := s.createRequestAndInvoice(&pr); err == nil {
+			t.Fatal("expected create to fail")
+		}
+		var saved models.PurchaseRequest
+		if err := s.db.Find(&saved, pr.ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if saved.InvoiceFailedAt == nil || saved.InvoiceError != err.Error() {
+			t.Errorf("InvoiceFailedAt = %v, InvoiceError = %q; want failed with %q", saved.InvoiceFailedAt, saved.InvoiceError, err)
+		}
+		if held, _ := seatsHeld(s.db, event, nil); held != 0 {
+			t.Errorf("seats held = %d after %s; not 0", held, err)
+		}
+		s.db.Model(&pr).UpdateColumn("created_at", time.Now().Add(-2*time.Minute))
+	}
+
+	s.resendInvoices()
+	if len(payments.invoices) != 0 {
+		t.Fatalf("resent %d failed invoices", len(payments.invoices))
+	}
+}
+
+func TestResendInvoicesGivesUpWhenRejected(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	payments.loseCreate = true
+	pr := models.PurchaseRequest{EventID: testEvent(t, s).ID, FirstName: "first", Email: "a@example.com", Type: models.Individual}
+	s.createRequestAndInvoice(&pr)
+	payments.invoices = nil
+	s.db.Model(&pr).UpdateColumn("created_at", time.Now().Add(-2*time.Minute))
+
+	// Square being down doesn't mean the invoice wasn't created.
+	payments.createErr = &square.TransportError{Err: errors.New("connection refused")}
+	s.resendInvoices()
+	payments.createErr = &square.ValidationError{ErrorMessage: "bad email"}
+	s.resendInvoices()
+	s.resendInvoices()
+	if len(payments.invoices) != 0 {
+		t.Fatalf("invoices = %d; not 0", len(payments.invoices))
+	}
+	var saved models.PurchaseRequest
+	if err := s.db.Find(&saved, pr.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if saved.InvoiceFailedAt == nil {
+		t.Error("rejected invoice not marked failed")
+	}
+}
+
+func TestBuyBulk(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+	testEvent(t, s)
+
+	bulk := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/buybulk", strings.NewReader(body))
+		s.buyBulk(w, &auth.AuthenticatedRequest{Request: *r})
+		return w
+	}
+	if w := bulk(`{"CSV": "Ada Lovelace,12345678,ada@example.com,6045551234\n"}`); w.Code != 400 {
+		t.Errorf("bulk without a ticket type = %d; not 400", w.Code)
+	}
+	w := bulk(`{"Type": "IndividualCS", "CSV": "Ada Lovelace,12345678,ada@example.com,6045551234,\n` +
+		`Grace Hopper,12345679,grace@example.com,6045551234,Individual\n"}`)
+	if w.Code != 200 {
+		t.Fatalf("bulk = %d: %s", w.Code, w.Body)
+	}
+	var prs []models.PurchaseRequest
+	s.db.Order("id").Find(&prs)
+	if len(prs) != 2 || prs[0].Type != models.IndividualCS || prs[1].Type != models.Individual {
+		t.Errorf("purchase requests = %+v; want IndividualCS then Individual", prs)
+	}
+	if len(payments.invoices) != 2 {
+		t.Errorf("invoices = %d; not 2", len(payments.invoices))
+	}
+}
+
+func TestCheckInvoicesCancelsStale(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	pr := models.PurchaseRequest{EventID: testEvent(t, s).ID, FirstName: "first", Type: models.Individual}
+	if err := s.createRequestAndInvoice(&pr); err != nil {
+		t.Fatal(err)
+	}
+	s.checkInvoices()
+	if len(payments.canceled) != 0 {
+		t.Fatalf("fresh invoice canceled")
+	}
+
+	s.db.Model(&pr).UpdateColumn("created_at", time.Now().Add(-25*time.Hour))
+	s.checkInvoices()
+	if len(payments.canceled) != 1 {
+		t.Fatalf("canceled = %v; want 1 invoice", payments.canceled)
+	}
+}
+
+func TestSquareWebhookIssuesTickets(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	key := *squareWebhookKey
+	*squareWebhookKey = "key"
+	defer func() { *squareWebhookKey = key }()
+
+	pr := models.PurchaseRequest{EventID: testEvent(t, s).ID, FirstName: "Amelia", Type: models.Individual}
+	if err := s.db.Create(&pr).Error; err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"type": "invoice.payment_made", "event_id": "1", "data": {"object": {"invoice": {
+		"id": "inv:1", "invoice_number": "` + defaultEvent().InvoiceReference(pr.ID) + `", "status": "PAID"}}}}`)
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte(*squareWebhookURL))
+	mac.Write(body)
+
+	for _, sig := range []string{"bad", base64.StdEncoding.EncodeToString(mac.Sum(nil))} {
+		r := httptest.NewRequest("POST", "/api/webhooks/square", bytes.NewReader(body))
+		r.Header.Set(square.WebhookSignatureHeader, sig)
+		w := httptest.NewRecorder()
+		s.squareWebhook(w, r)
+		if sig == "bad" && w.Code != 401 {
+			t.Errorf("bad signature got %d; not 401", w.Code)
+		} else if sig != "bad" && w.Code != 200 {
+			t.Errorf("valid signature got %d: %s", w.Code, w.Body)
+		}
+	}
+
+	var count int
+	s.db.Model(&models.Ticket{}).Count(&count)
+	if count != 1 {
+		t.Fatalf("webhook issued %d tickets; not 1", count)
+	}
+}
+
+func TestSquareWebhookUnknownInvoice(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+	testEvent(t, s)
+
+	key := *squareWebhookKey
+	*squareWebhookKey = "key"
+	defer func() { *squareWebhookKey = key }()
+
+	body := []byte(`{"type": "invoice.payment_made", "event_id": "1", "data": {"object": {"invoice": {
+		"id": "inv:1", "invoice_number": "` + defaultEvent().InvoiceReference(404) + `", "status": "PAID"}}}}`)
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte(*squareWebhookURL))
+	mac.Write(body)
+	r := httptest.NewRequest("POST", "/api/webhooks/square", bytes.NewReader(body))
+	r.Header.Set(square.WebhookSignatureHeader, base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	w := httptest.NewRecorder()
+	s.squareWebhook(w, r)
+	if w.Code != 200 {
+		t.Errorf("webhook for an unknown purchase request = %d; not 200 so Square stops retrying", w.Code)
+	}
+}
+
+func TestProcessInvoiceLeavesPartialPayments(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	for _, state := range []string{"PAYMENT_PENDING", "PARTIALLY_PAID", "SCHEDULED"} {
+		pr := models.PurchaseRequest{EventID: testEvent(t, s).ID, FirstName: state, Email: strings.ToLower(state) + "@example.com", Type: models.Individual}
+		if err := s.createRequestAndInvoice(&pr); err != nil {
+			t.Fatal(err)
+		}
+		s.db.Model(&pr).UpdateColumn("created_at", time.Now().Add(-25*time.Hour))
+		payments.invoices[len(payments.invoices)-1].State = state
+	}
+	s.checkInvoices()
+	if len(payments.canceled) != 0 {
+		t.Errorf("canceled %v; invoices being paid shouldn't be", payments.canceled)
+	}
+	var count int
+	s.db.Model(&models.Ticket{}).Count(&count)
+	if count != 0 {
+		t.Errorf("issued %d tickets for invoices not paid in full", count)
+	}
+}
+
+func TestProcessInvoiceIgnoresStaleUpdates(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+	event := testEvent(t, s)
+
+	pr := models.PurchaseRequest{EventID: event.ID, FirstName: "Amelia", Type: models.Individual}
+	if err := s.db.Create(&pr).Error; err != nil {
+		t.Fatal(err)
+	}
+	at := func(t time.Time) *square.Time {
+		return &square.Time{InstantUsec: uint64(t.UnixNano() / 1000)}
+	}
+	created := time.Now().Add(-time.Hour)
+	invoice := func(state string, updated time.Time) *square.Invoice {
+		return &square.Invoice{
+			Token:                 "inv:1",
+			MerchantInvoiceNumber: event.InvoiceReference(pr.ID),
+			State:                 state,
+			UpdatedAt:             at(updated),
+		}
+	}
+
+	if err := s.processInvoice(invoice("UNPAID", created)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.processInvoice(invoice("CANCELED", created.Add(2*time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	// The payment made before the cancellation arrives late.
+	if err := s.processInvoice(invoice("PAID", created.Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+	var saved models.PurchaseRequest
+	s.db.Find(&saved, pr.ID)
+	if saved.InvoiceState != "CANCELED" {
+		t.Errorf("InvoiceState = %q; not CANCELED", saved.InvoiceState)
+	}
+	var count int
+	s.db.Model(&models.Ticket{}).Count(&count)
+	if count != 0 {
+		t.Errorf("stale update issued %d tickets", count)
+	}
+}
+
+func TestBuyIssuesTicketsEndToEnd(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	srv := squaretest.NewServer()
+	defer srv.Close()
+	sq, err := square.NewClient(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.payments = sq
+
+	var sent []string
+	sendEmail = func(to, subj, body string, files ...email.File) error {
+		sent = append(sent, to)
+		return nil
+	}
+
+	body := `{"FirstName": "Ada", "LastName": "Lovelace", "StudentID": "12345678",
+		"Email": "ada@example.com", "PhoneNumber": "6045551234", "RawType": "Individual"}`
+	w := httptest.NewRecorder()
+	s.buy(w, httptest.NewRequest("POST", "/api/buy", strings.NewReader(body)))
+	if w.Code != 200 {
+		t.Fatalf("buy = %d: %s", w.Code, w.Body)
+	}
+
+	invoices := srv.Invoices()
+	if len(invoices) != 1 {
+		t.Fatalf("invoices = %d; not 1", len(invoices))
+	}
+	if got := invoices[0].RequestedMoney.Amount; got != int(*priceIndividual*100) {
+		t.Errorf("invoice amount = %d", got)
+	}
+
+	s.checkInvoices()
+	if len(sent) != 0 {
+		t.Fatalf("unpaid invoice sent tickets to %v", sent)
+	}
+	if err := srv.Pay(invoices[0].Token); err != nil {
+		t.Fatal(err)
+	}
+	s.checkInvoices()
+
+	var tickets []models.Ticket
+	if err := s.db.Find(&tickets).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(tickets) != 1 || tickets[0].Email != "ada@example.com" {
+		t.Fatalf("tickets = %+v", tickets)
+	}
+	if len(sent) != 1 || sent[0] != "ada@example.com" {
+		t.Errorf("emails sent to %v", sent)
+	}
+}
+
+func TestBuySquareUnavailable(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	srv := squaretest.NewServer()
+	sq, err := square.NewClient(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+	s.payments = sq
+
+	body := `{"FirstName": "Ada", "LastName": "Lovelace", "StudentID": "12345678",
+		"Email": "ada@example.com", "PhoneNumber": "6045551234", "RawType": "Individual"}`
+	w := httptest.NewRecorder()
+	s.buy(w, httptest.NewRequest("POST", "/api/buy", strings.NewReader(body)))
+	if w.Code != 503 {
+		t.Fatalf("buy with square down = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSaveEvent(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+	event := testEvent(t, s)
+	workshop := models.Event{Slug: "workshop", Name: "Workshop", Capacity: 20, InvoicePrefix: "Workshop", Venue: "ICICS"}
+	if err := s.db.Create(&workshop).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	patch := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PATCH", "/api/events", strings.NewReader(body))
+		s.saveEvent(w, &auth.AuthenticatedRequest{Request: *r})
+		return w
+	}
+	if w := patch(fmt.Sprintf(`{"ID": %d, "capacity": 30}`, workshop.ID)); w.Code != 200 {
+		t.Fatalf("patch = %d %s", w.Code, w.Body)
+	}
+	var saved models.Event
+	s.db.First(&saved, workshop.ID)
+	if saved.Capacity != 30 || saved.Name != "Workshop" || saved.Venue != "ICICS" || saved.InvoicePrefix != "Workshop" {
+		t.Errorf("patched event = %+v; want only the capacity changed", saved)
+	}
+
+	if w := patch(fmt.Sprintf(`{"ID": %d, "Slug": "gala-2019"}`, event.ID)); w.Code != 400 {
+		t.Errorf("rename the default event = %d; not 400", w.Code)
+	}
+	if w := patch(`{"ID": 404, "Name": "Nope"}`); w.Code != 404 {
+		t.Errorf("patch unknown event = %d; not 404", w.Code)
+	}
+}
+
+func TestEventScopedBuy(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	event := models.Event{
+		Slug:          "frosh",
+		Name:          "CSSS Frosh",
+		Capacity:      1,
+		InvoicePrefix: "Frosh2018",
+	}
+	if err := s.db.Create(&event).Error; err != nil {
+		t.Fatal(err)
+	}
+	tt := models.TicketType{EventID: event.ID, Name: models.Individual, Price: 10, Seats: 1}
+	if err := s.db.Create(&tt).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"FirstName": "Ada", "LastName": "Lovelace", "StudentID": "12345678",
+		"Email": "ada@example.com", "PhoneNumber": "6045551234", "RawType": "Individual"}`
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("POST", "/api/events/frosh/buy", strings.NewReader(body)))
+	if w.Code != 200 {
+		t.Fatalf("buy = %d: %s", w.Code, w.Body)
+	}
+	if len(payments.invoices) != 1 {
+		t.Fatalf("invoices = %d; not 1", len(payments.invoices))
+	}
+	invoice := payments.invoices[0]
+	if !strings.HasPrefix(invoice.MerchantInvoiceNumber, "Frosh2018 ") || invoice.RequestedMoney.Amount != 1000 {
+		t.Errorf("invoice = %+v", invoice)
+	}
+
+	invoice.State = "PAID"
+	s.checkInvoices()
+	var tickets []models.Ticket
+	s.db.Find(&tickets)
+	if len(tickets) != 1 || tickets[0].EventID != event.ID {
+		t.Fatalf("tickets = %+v", tickets)
+	}
+
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("POST", "/api/events/frosh/buy", strings.NewReader(body)))
+	if w.Code != 400 {
+		t.Errorf("buy past capacity = %d; not 400", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("POST", "/api/buy", strings.NewReader(body)))
+	if w.Code != 200 {
+		t.Errorf("buy for default event = %d: %s", w.Code, w.Body)
+	}
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("POST", "/api/events/nope/buy", strings.NewReader(body)))
+	if w.Code != 404 {
+		t.Errorf("buy for missing event = %d; not 404", w.Code)
+	}
+}
+
+func TestTicketTypes(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	event := testEvent(t, s)
+	alumni := models.TicketType{
+		EventID:     event.ID,
+		Name:        "Alumni",
+		Price:       50,
+		Seats:       2,
+		Cap:         2,
+		EmailSuffix: "@alumni.ubc.ca",
+	}
+	if err := s.db.Create(&alumni).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	buy := func(email string) *httptest.ResponseRecorder {
+		body := `{"FirstName": "Ada", "LastName": "Lovelace", "Email": "` + email + `",
+			"PhoneNumber": "6045551234", "RawType": "Alumni", "Attendees": [
+			{"FirstName": "Ada", "LastName": "Lovelace", "Email": "` + email + `", "PhoneNumber": "6045551234"},
+			{"FirstName": "Charles", "LastName": "Babbage", "Email": "charles@example.com", "PhoneNumber": "6045554321"}]}`
+		w := httptest.NewRecorder()
+		s.buy(w, httptest.NewRequest("POST", "/api/buy", strings.NewReader(body)))
+		return w
+	}
+	if w := buy("ada@example.com"); w.Code != 400 {
+		t.Errorf("ineligible email = %d; not 400", w.Code)
+	}
+	if w := buy("ada@alumni.ubc.ca"); w.Code != 200 {
+		t.Fatalf("buy = %d: %s", w.Code, w.Body)
+	}
+	if got := payments.invoices[0].RequestedMoney.Amount; got != 5000 {
+		t.Errorf("invoice amount = %d; not 5000", got)
+	}
+
+	payments.invoices[0].State = "PAID"
+	s.checkInvoices()
+	var count int
+	s.db.Model(&models.Ticket{}).Count(&count)
+	if count != 2 {
+		t.Fatalf("issued %d tickets; not 2", count)
+	}
+	if w := buy("grace@alumni.ubc.ca"); w.Code != 400 {
+		t.Errorf("buy past the type's cap = %d; not 400", w.Code)
+	}
+
+	w := httptest.NewRecorder()
+	s.stats(w, &auth.AuthenticatedRequest{Request: *httptest.NewRequest("GET", "/api/stats", nil)})
+	var stats Stats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.PeopleCount != 2 || stats.PeopleByType["Alumni"] != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestPriceTiers(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer func() { now = time.Now }()
+	now = func() time.Time { return start }
+
+	event := testEvent(t, s)
+	var tt models.TicketType
+	if err := s.db.Where("event_id = ? AND name = ?", event.ID, models.Individual).First(&tt).Error; err != nil {
+		t.Fatal(err)
+	}
+	end := start.Add(time.Hour)
+	tiers := []models.PriceTier{
+		{TicketTypeID: tt.ID, Name: "Late", Price: 40, StartsAt: &end},
+		{TicketTypeID: tt.ID, Name: "Early Bird", Price: 20, EndsAt: &end, MaxSales: 1},
+		{TicketTypeID: tt.ID, Name: "Regular", Price: 30, EndsAt: &end},
+	}
+	for i := range tiers {
+		if err := s.db.Create(&tiers[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	details := func() DetailsResponse {
+		w := httptest.NewRecorder()
+		s.details(w, httptest.NewRequest("GET", "/api/details?type=Individual", nil))
+		var resp DetailsResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	buyers := 0
+	buy := func() {
+		buyers++
+		body := fmt.Sprintf(`{"FirstName": "Ada", "LastName": "Lovelace", "StudentID": "12345678",
+			"Email": "ada%d@example.com", "PhoneNumber": "6045551234", "RawType": "Individual"}`, buyers)
+		w := httptest.NewRecorder()
+		s.buy(w, httptest.NewRequest("POST", "/api/buy", strings.NewReader(body)))
+		if w.Code != 200 {
+			t.Fatalf("buy = %d: %s", w.Code, w.Body)
+		}
+	}
+
+	resp := details()
+	if resp.Tier == nil || resp.Tier.Name != "Early Bird" || resp.Price != "20.00" {
+		t.Fatalf("details = %+v", resp)
+	}
+	if resp.Tier.SalesLeft == nil || *resp.Tier.SalesLeft != 1 || !resp.Tier.EndsAt.Equal(end) {
+		t.Errorf("tier = %+v", resp.Tier)
+	}
+	buy()
+	if resp := details(); resp.Tier == nil || resp.Tier.Name != "Regular" || resp.Tier.SalesLeft != nil {
+		t.Errorf("details after early bird sold out = %+v", resp.Tier)
+	}
+	buy()
+	now = func() time.Time { return end }
+	if resp := details(); resp.Tier == nil || resp.Tier.Name != "Late" || resp.Prices[models.Individual] != 40 {
+		t.Errorf("details after regular ended = %+v", resp)
+	}
+
+	var prs []models.PurchaseRequest
+	s.db.Order("id").Find(&prs)
+	if len(prs) != 2 || prs[0].Charged != 20 || prs[0].PriceTierID != tiers[1].ID || prs[1].Charged != 30 {
+		t.Errorf("purchase requests = %+v", prs)
+	}
+	if got := payments.invoices[1].RequestedMoney.Amount; got != 3000 {
+		t.Errorf("second invoice amount = %d; not 3000", got)
+	}
+}
+
+func TestTierSalesSkipFailedAndAbandoned(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+	defer func() { now = time.Now }()
+
+	event := testEvent(t, s)
+	var tt models.TicketType
+	if err := s.db.Where("event_id = ? AND name = ?", event.ID, models.Individual).First(&tt).Error; err != nil {
+		t.Fatal(err)
+	}
+	tier := models.PriceTier{TicketTypeID: tt.ID, Name: "Early Bird", Price: 20, MaxSales: 1}
+	if err := s.db.Create(&tier).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	failed := time.Now()
+	prs := []models.PurchaseRequest{
+		{EventID: event.ID, Type: tt.Name, PriceTierID: tier.ID, InvoiceFailedAt: &failed},
+		// Never invoiced, so abandoned once it's a day old.
+		{EventID: event.ID, Type: tt.Name, PriceTierID: tier.ID},
+	}
+	for i := range prs {
+		if err := s.db.Create(&prs[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sales, err := s.tierSales(&tier); err != nil || sales != 1 {
+		t.Errorf("tierSales = %d, %v; want just the one waiting to be invoiced", sales, err)
+	}
+	now = func() time.Time { return time.Now().Add(25 * time.Hour) }
+	if sales, err := s.tierSales(&tier); err != nil || sales != 0 {
+		t.Errorf("tierSales = %d, %v; want none once abandoned", sales, err)
+	}
+}
+
+func TestDetailsPromoCodeErrors(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+	testEvent(t, s)
+
+	details := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.details(w, httptest.NewRequest("GET", "/api/details?type=Individual&code=NOPE", nil))
+		return w
+	}
+	w := details()
+	var resp ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 400 || len(resp.Fields) != 1 || resp.Fields[0].Field != "PromoCode" {
+		t.Errorf("unknown promo code = %d %+v; want a 400 PromoCode field error", w.Code, resp)
+	}
+
+	s.db.DropTable(&models.PromoCode{})
+	if w := details(); w.Code != 500 {
+		t.Errorf("promo code db error = %d; not 500", w.Code)
+	}
+}
+
+// newSmallEvent creates an event with room for capacity people and a single
+// one seat ticket type.
+func newSmallEvent(t *testing.T, s *server, capacity int) *models.Event {
+	event := models.Event{
+		Slug:          "workshop",
+		Name:          "CSSS Workshop",
+		Capacity:      capacity,
+		InvoicePrefix: "Workshop2018",
+	}
+	if err := s.db.Create(&event).Error; err != nil {
+		t.Fatal(err)
+	}
+	tt := models.TicketType{EventID: event.ID, Name: models.Individual, Price: 5, Seats: 1}
+	if err := s.db.Create(&tt).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &event
+}
+
+// workshopBuyers numbers the buyers of buyWorkshop, since each attendee can
+// only be in one unpaid purchase.
+var workshopBuyers int64
+
+func buyWorkshop(s *server) *httptest.ResponseRecorder {
+	body := fmt.Sprintf(`{"FirstName": "Ada", "LastName": "Lovelace", "StudentID": "12345678",
+		"Email": "ada%d@example.com", "PhoneNumber": "6045551234", "RawType": "Individual"}`,
+		atomic.AddInt64(&workshopBuyers, 1))
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("POST", "/api/events/workshop/buy", strings.NewReader(body)))
+	return w
+}
+
+func TestReservationsHoldSeats(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+	newSmallEvent(t, s, 2)
+
+	for i := 0; i < 2; i++ {
+		if w := buyWorkshop(s); w.Code != 200 {
+			t.Fatalf("buy %d = %d: %s", i, w.Code, w.Body)
+		}
+	}
+	if w := buyWorkshop(s); w.Code != 400 {
+		t.Fatalf("buy with every seat held = %d; not 400", w.Code)
+	}
+
+	var pr models.PurchaseRequest
+	s.db.Order("id").First(&pr)
+	s.db.Model(&pr).UpdateColumn("created_at", time.Now().Add(-25*time.Hour))
+	s.checkInvoices()
+	if len(payments.canceled) != 1 {
+		t.Fatalf("canceled = %v; want 1 invoice", payments.canceled)
+	}
+	if w := buyWorkshop(s); w.Code != 200 {
+		t.Fatalf("buy after a stale invoice was canceled = %d: %s", w.Code, w.Body)
+	}
+
+	payments.invoices[1].State = "PAID"
+	s.checkInvoices()
+	var held int
+	s.db.Model(&models.Reservation{}).Where("released_at IS NULL").Count(&held)
+	if held != 1 {
+		t.Errorf("held reservations = %d; not 1", held)
+	}
+	if w := buyWorkshop(s); w.Code != 400 {
+		t.Errorf("buy with one paid and one held seat = %d; not 400", w.Code)
+	}
+}
+
+func TestReleaseAbandonedUsesClock(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+	defer func() { now = time.Now }()
+
+	pr := models.PurchaseRequest{EventID: testEvent(t, s).ID, FirstName: "Ada", Email: "ada@example.com", Type: models.Individual}
+	if err := s.createAndReserve(&pr, nil); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(25 * time.Hour).Truncate(time.Second)
+	now = func() time.Time { return later }
+	s.releaseAbandoned()
+	var reservation models.Reservation
+	s.db.Where("purchase_request_id = ?", pr.ID).First(&reservation)
+	if reservation.ReleasedAt == nil || !reservation.ReleasedAt.Equal(later) {
+		t.Errorf("ReleasedAt = %v; not %s", reservation.ReleasedAt, later)
+	}
+}
+
+func TestReservationsConcurrent(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+	newSmallEvent(t, s, 3)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 10)
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- buyWorkshop(s).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	ok := 0
+	for code := range codes {
+		if code == 200 {
+			ok++
+		}
+	}
+	if ok != 3 {
+		t.Errorf("%d buys succeeded; not 3", ok)
+	}
+	if n := len(payments.invoices); n != 3 {
+		t.Errorf("invoices = %d; not 3", n)
+	}
+}
+
+func TestMigrateReservations(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+	event := newSmallEvent(t, s, 2)
+
+	for i := 0; i < 2; i++ {
+		if w := buyWorkshop(s); w.Code != 200 {
+			t.Fatalf("buy %d = %d: %s", i, w.Code, w.Body)
+		}
+	}
+	var prs []models.PurchaseRequest
+	s.db.Order("id").Find(&prs)
+	// As if both were invoiced before reservations existed, and one was paid.
+	s.db.Delete(&models.Reservation{})
+	s.db.Model(&prs[1]).UpdateColumn("invoice_state", "PAID")
+
+	if err := s.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	var reservations []models.Reservation
+	s.db.Find(&reservations)
+	if len(reservations) != 1 || reservations[0].PurchaseRequestID != prs[0].ID || reservations[0].EventID != event.ID {
+		t.Fatalf("reservations = %+v; want one for purchase request %d", reservations, prs[0].ID)
+	}
+}
+
+func TestResendInvoicesHoldsSeats(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+	newSmallEvent(t, s, 1)
+
+	payments.loseCreate = true
+	if w := buyWorkshop(s); w.Code != 503 {
+		t.Fatalf("buy with lost create = %d: %s", w.Code, w.Body)
+	}
+	payments.invoices = nil
+	var pr models.PurchaseRequest
+	s.db.First(&pr)
+	s.db.Model(&pr).UpdateColumn("created_at", time.Now().Add(-2*time.Minute))
+
+	releaseSeats(s.db, pr.ID, "test")
+	s.resendInvoices()
+	var held int
+	s.db.Model(&models.Reservation{}).Where("purchase_request_id = ? AND released_at IS NULL", pr.ID).Count(&held)
+	if held != 1 || len(payments.invoices) != 1 {
+		t.Fatalf("held = %d, invoices = %d; want the seat held again and 1 invoice", held, len(payments.invoices))
+	}
+	if w := buyWorkshop(s); w.Code != 400 {
+		t.Errorf("buy with the seat held = %d; not 400", w.Code)
+	}
+}
+
+func TestResendInvoicesSoldOut(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+	newSmallEvent(t, s, 1)
+
+	payments.loseCreate = true
+	buyWorkshop(s)
+	payments.invoices = nil
+	var pr models.PurchaseRequest
+	s.db.First(&pr)
+	s.db.Model(&pr).UpdateColumn("created_at", time.Now().Add(-2*time.Minute))
+	releaseSeats(s.db, pr.ID, "test")
+	if w := buyWorkshop(s); w.Code != 200 {
+		t.Fatalf("buy = %d: %s", w.Code, w.Body)
+	}
+
+	s.resendInvoices()
+	if len(payments.invoices) != 1 {
+		t.Fatalf("invoices = %d; not 1", len(payments.invoices))
+	}
+	s.db.First(&pr, pr.ID)
+	if pr.InvoiceFailedAt == nil {
+		t.Error("request with no seats left not marked failed")
+	}
+}
+
+func joinWorkshopWaitlist(s *server, email string) *httptest.ResponseRecorder {
+	body := `{"FirstName": "Grace", "LastName": "Hopper", "StudentID": "12345678",
+		"Email": "` + email + `", "PhoneNumber": "6045551234", "RawType": "Individual"}`
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("POST", "/api/events/workshop/waitlist", strings.NewReader(body)))
+	return w
+}
+
+func TestWaitlist(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+	event := newSmallEvent(t, s, 1)
+
+	if w := joinWorkshopWaitlist(s, "early@example.com"); w.Code != 400 {
+		t.Fatalf("join waitlist with seats left = %d; not 400", w.Code)
+	}
+	if w := buyWorkshop(s); w.Code != 200 {
+		t.Fatalf("buy = %d: %s", w.Code, w.Body)
+	}
+	for i, email := range []string{"first@example.com", "second@example.com"} {
+		w := joinWorkshopWaitlist(s, email)
+		if w.Code != 200 {
+			t.Fatalf("join waitlist = %d: %s", w.Code, w.Body)
+		}
+		var resp WaitlistResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Position != i+1 {
+			t.Errorf("position = %d; not %d", resp.Position, i+1)
+		}
+	}
+
+	var sent []string
+	sendEmail = func(to, subj, body string, files ...email.File) error {
+		sent = append(sent, to)
+		return nil
+	}
+	s.db.Model(&models.PurchaseRequest{}).UpdateColumn("created_at", time.Now().Add(-25*time.Hour))
+	s.checkInvoices()
+	if len(sent) != 1 || sent[0] != "first@example.com" {
+		t.Fatalf("emails sent to %v; want only the first on the waitlist", sent)
+	}
+	if w := buyWorkshop(s); w.Code != 400 {
+		t.Fatalf("buy while a waitlist offer is held = %d; not 400", w.Code)
+	}
+
+	// The price is locked in when the offer is made.
+	s.db.Model(&models.TicketType{}).Where("event_id = ?", event.ID).UpdateColumn("price", 50)
+	var first models.WaitlistEntry
+	s.db.Where("email = ?", "first@example.com").First(&first)
+	claim := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("POST", "/api/waitlist/claim/"+token, nil))
+		return w
+	}
+	if w := claim(first.ClaimToken); w.Code != 200 {
+		t.Fatalf("claim = %d: %s", w.Code, w.Body)
+	}
+	if w := claim(first.ClaimToken); w.Code != 400 {
+		t.Fatalf("claim again = %d; not 400", w.Code)
+	}
+	var pr models.PurchaseRequest
+	s.db.Where("email = ?", "first@example.com").First(&pr)
+	if pr.Charged != 5 {
+		t.Errorf("charged = %v; not the locked price 5", pr.Charged)
+	}
+	if n := len(payments.invoices); n != 2 {
+		t.Fatalf("invoices = %d; not 2", n)
+	}
+
+	// An offer that isn't claimed in time goes back on sale.
+	s.db.Model(&pr).UpdateColumn("created_at", time.Now().Add(-25*time.Hour))
+	s.checkInvoices()
+	var second models.WaitlistEntry
+	s.db.Where("email = ?", "second@example.com").First(&second)
+	if second.ClaimToken == "" {
+		t.Fatal("second on the waitlist wasn't invited")
+	}
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Now().Add(*claimWindow + time.Minute) }
+	if w := claim(second.ClaimToken); w.Code != 400 {
+		t.Fatalf("expired claim = %d; not 400", w.Code)
+	}
+	s.checkInvoices()
+	if w := buyWorkshop(s); w.Code != 200 {
+		t.Fatalf("buy after the offer expired = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestWaitlistDuplicatesAndFailedInvites(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+	newSmallEvent(t, s, 1)
+
+	if w := buyWorkshop(s); w.Code != 200 {
+		t.Fatalf("buy = %d: %s", w.Code, w.Body)
+	}
+	if w := joinWorkshopWaitlist(s, "first@example.com"); w.Code != 200 {
+		t.Fatalf("join waitlist = %d: %s", w.Code, w.Body)
+	}
+	if w := joinWorkshopWaitlist(s, "First@example.com"); w.Code != 400 || !strings.Contains(w.Body.String(), "already_waitlisted") {
+		t.Fatalf("join waitlist twice = %d: %s", w.Code, w.Body)
+	}
+	if w := joinWorkshopWaitlist(s, "second@example.com"); w.Code != 200 {
+		t.Fatalf("join waitlist = %d: %s", w.Code, w.Body)
+	}
+
+	var sent []string
+	sendEmail = func(to, subj, body string, files ...email.File) error {
+		if to == "first@example.com" {
+			return errors.New("mailbox unavailable")
+		}
+		sent = append(sent, to)
+		return nil
+	}
+	s.db.Model(&models.PurchaseRequest{}).UpdateColumn("created_at", time.Now().Add(-25*time.Hour))
+	s.checkInvoices()
+	if len(sent) != 1 || sent[0] != "second@example.com" {
+		t.Fatalf("emails sent to %v; want the second on the waitlist after the first failed", sent)
+	}
+	var first models.WaitlistEntry
+	s.db.Where("email = ?", "first@example.com").First(&first)
+	if first.InviteError == "" || first.ExpiresAt == nil {
+		t.Errorf("failed invite = %+v; want it expired with an error", first)
+	}
+
+	// Whoever's offer expired can join again.
+	if w := joinWorkshopWaitlist(s, "first@example.com"); w.Code != 200 {
+		t.Fatalf("join waitlist after a failed invite = %d: %s", w.Code, w.Body)
+	}
+	for i := 0; i < 2; i++ {
+		joinWorkshopWaitlist(s, fmt.Sprintf("more%d@example.com", i))
+	}
+	if w := joinWorkshopWaitlist(s, "last@example.com"); w.Code != 429 {
+		t.Fatalf("join waitlist past the limit = %d; not 429", w.Code)
+	}
+}
+
+func TestAttendees(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+	event := testEvent(t, s)
+
+	// Purchase requests from before attendees had flat group member columns.
+	for n := 2; n <= 4; n++ {
+		for _, field := range []string{"first_name", "last_name", "email", "phone_number"} {
+			if err := s.db.Exec(fmt.Sprintf("ALTER TABLE purchase_requests ADD COLUMN group_member%d_%s varchar(255)", n, field)).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := s.db.Exec("INSERT INTO purchase_requests (event_id, first_name, last_name, email, type, "+
+		"group_member2_first_name, group_member2_email, group_member3_first_name) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		event.ID, "Ada", "Lovelace", "ada@example.com", models.Group, "Grace", "grace@example.com", "Alan").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.migrateAttendees(); err != nil {
+		t.Fatal(err)
+	}
+	var legacy []models.Attendee
+	s.db.Order("position").Find(&legacy)
+	if len(legacy) != 3 || legacy[0].Email != "ada@example.com" || legacy[1].Email != "grace@example.com" || legacy[2].FirstName != "Alan" {
+		t.Fatalf("migrated attendees = %+v", legacy)
+	}
+	if err := s.migrateAttendees(); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	s.db.Model(&models.Attendee{}).Count(&count)
+	if count != 3 {
+		t.Fatalf("migrating again made %d attendees; not 3", count)
+	}
+
+	// The buy form still posts the flat fields.
+	body := `{"FirstName": "Ada", "LastName": "Lovelace", "StudentID": "12345678",
+		"Email": "ada@example.com", "PhoneNumber": "6045551234", "RawType": "Group",
+		"GroupMember2FirstName": "Grace", "GroupMember2LastName": "Hopper", "GroupMember2Email": "grace@example.com", "GroupMember2PhoneNumber": "6045550002",
+		"GroupMember3FirstName": "Alan", "GroupMember3LastName": "Turing", "GroupMember3Email": "alan@example.com", "GroupMember3PhoneNumber": "6045550003"}`
+	w := httptest.NewRecorder()
+	s.buy(w, httptest.NewRequest("POST", "/api/buy", strings.NewReader(body)))
+	if w.Code != 400 {
+		t.Fatalf("group of three = %d; not 400", w.Code)
+	}
+	body = strings.Replace(body, `"RawType": "Group",`, `"RawType": "Group",
+		"GroupMember4FirstName": "Edsger", "GroupMember4LastName": "Dijkstra", "GroupMember4Email": "edsger@example.com", "GroupMember4PhoneNumber": "6045550004",`, 1)
+	w = httptest.NewRecorder()
+	s.buy(w, httptest.NewRequest("POST", "/api/buy", strings.NewReader(body)))
+	if w.Code != 200 {
+		t.Fatalf("buy = %d: %s", w.Code, w.Body)
+	}
+
+	payments.invoices[0].State = "PAID"
+	s.checkInvoices()
+	var tickets []models.Ticket
+	s.db.Order("email").Find(&tickets)
+	var emails []string
+	for _, ticket := range tickets {
+		emails = append(emails, ticket.Email)
+	}
+	want := []string{"ada@example.com", "alan@example.com", "edsger@example.com", "grace@example.com"}
+	if !reflect.DeepEqual(emails, want) {
+		t.Errorf("tickets for %v; want %v", emails, want)
+	}
+}
+
+func TestValidateAttendees(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	buy := func(members string) (int, ErrorResponse) {
+		body := `{"FirstName": "Ada", "LastName": "Lovelace", "StudentID": "12345678",
+			"Email": "ada@example.com", "PhoneNumber": "6045551234", "RawType": "Group", "Attendees": [
+			{"FirstName": "Ada", "LastName": "Lovelace", "Email": "ada@example.com", "PhoneNumber": "6045551234"},
+			` + members + `]}`
+		w := httptest.NewRecorder()
+		s.buy(w, httptest.NewRequest("POST", "/api/buy", strings.NewReader(body)))
+		var resp ErrorResponse
+		if w.Code != 200 {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, resp
+	}
+	fields := func(resp ErrorResponse) []string {
+		var fields []string
+		for _, f := range resp.Fields {
+			fields = append(fields, f.Field)
+		}
+		return fields
+	}
+
+	code, resp := buy(`{"FirstName": "", "LastName": "Hopper", "Email": "grace@example.com", "PhoneNumber": "1"},
+		{"FirstName": "Alan", "LastName": "Turing", "Email": "not an email", "PhoneNumber": "1"},
+		{"FirstName": "Edsger", "LastName": "Dijkstra", "Email": "ADA@example.com", "PhoneNumber": ""}`)
+	want := []string{"Attendees[1].FirstName", "Attendees[2].Email", "Attendees[3].PhoneNumber", "Attendees[3].Email"}
+	if code != 400 || !reflect.DeepEqual(fields(resp), want) {
+		t.Fatalf("buy = %d %+v; want 400 with fields %v", code, resp, want)
+	}
+
+	members := `{"FirstName": "Grace", "LastName": "Hopper", "Email": "grace@example.com", "PhoneNumber": "1"},
+		{"FirstName": "Alan", "LastName": "Turing", "Email": "alan@example.com", "PhoneNumber": "1"},
+		{"FirstName": "Edsger", "LastName": "Dijkstra", "Email": "edsger@example.com", "PhoneNumber": "1"}`
+	if code, resp := buy(members); code != 200 {
+		t.Fatalf("buy = %d: %+v", code, resp)
+	}
+	code, resp = buy(strings.Replace(members, "grace@", "hopper@", 1))
+	want = []string{"Attendees[0].Email", "Attendees[2].Email", "Attendees[3].Email"}
+	if code != 400 || !reflect.DeepEqual(fields(resp), want) || resp.Fields[0].Code != "pending_purchase" {
+		t.Fatalf("buy for unpaid attendees = %d %+v; want 400 with fields %v", code, resp, want)
+	}
+	if msg := resp.Fields[0].Message; !strings.Contains(msg, payments.invoices[0].MerchantInvoiceNumber) || !strings.Contains(msg, "Pay that invoice") {
+		t.Errorf("pending purchase message %q doesn't name the invoice and how to resolve it", msg)
+	}
+	payments.invoices[0].State = "PAID"
+	s.checkInvoices()
+
+	code, resp = buy(strings.Replace(members, "grace@", "hopper@", 1))
+	want = []string{"Attendees[0].Email", "Attendees[2].Email", "Attendees[3].Email"}
+	if code != 400 || !reflect.DeepEqual(fields(resp), want) {
+		t.Fatalf("buy for ticket holders = %d %+v; want 400 with fields %v", code, resp, want)
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+	newSmallEvent(t, s, 0)
+
+	do := func(method, path, body string) (*httptest.ResponseRecorder, ErrorResponse) {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, r)
+		var resp ErrorResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+		if id := w.Header().Get(requestIDHeader); id == "" || id != resp.RequestID {
+			t.Errorf("%s %s: request ID %q; header %q", method, path, resp.RequestID, id)
+		}
+		return w, resp
+	}
+
+	if w, resp := do("POST", "/api/events/workshop/buy", `{"FirstName": "Ada", "LastName": "Lovelace",
+		"Email": "ada@example.com", "PhoneNumber": "6045551234", "RawType": "Individual"}`); w.Code != 400 || resp.Code != "sold_out" {
+		t.Errorf("sold out = %d %+v", w.Code, resp)
+	}
+	if w, resp := do("POST", "/api/events/workshop/buy", `{"RawType": "VIP"}`); w.Code != 400 || resp.Code != "unknown_ticket_type" {
+		t.Errorf("unknown type = %d %+v", w.Code, resp)
+	}
+
+	if w, resp := do("GET", "/api/events/nope/details", ""); w.Code != 404 || resp.Code != "unknown_event" {
+		t.Errorf("unknown event = %d %+v", w.Code, resp)
+	}
+
+	s.db.Close()
+	if w, resp := do("GET", "/api/events/workshop/details", ""); w.Code != 500 || strings.Contains(resp.Message, "sql") {
+		t.Errorf("event db error = %d %+v; want a 500 without details", w.Code, resp)
+	}
+	w, resp := do("GET", "/api/events", "")
+	if w.Code != 500 || resp.Code != "internal" || !strings.Contains(resp.Message, resp.RequestID) || strings.Contains(resp.Message, "sql") {
+		t.Errorf("internal error = %d %+v", w.Code, resp)
+	}
+	*debug = true
+	defer func() { *debug = false }()
+	if _, resp := do("GET", "/api/events", ""); !strings.Contains(resp.Message, "sql") {
+		t.Errorf("internal error in debug mode = %+v; want the real error", resp)
+	}
+}
+
+func TestCheckIn(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+	event := testEvent(t, s)
+	workshop := newSmallEvent(t, s, 10)
+
+	ticket := newTicket("Ada", "Lovelace", "6045551234", "ada@example.com", 1)
+	ticket.EventID = event.ID
+	if err := s.db.Create(&ticket).Error; err != nil {
+		t.Fatal(err)
+	}
+	token := s.signer.sign(&ticket)
+	checkIn := func(method, slug, token, body string) (*httptest.ResponseRecorder, ErrorResponse) {
+		r := httptest.NewRequest(method, "/", strings.NewReader(body))
+		vars := map[string]string{"token": token}
+		if slug != "" {
+			vars["slug"] = slug
+		}
+		r = mux.SetURLVars(r, vars)
+		w := httptest.NewRecorder()
+		s.checkIn(w, &auth.AuthenticatedRequest{Request: *r, Username: "admin"})
+		var resp ErrorResponse
+		if w.Code != 200 {
+			json.NewDecoder(w.Body).Decode(&resp)
+		}
+		return w, resp
+	}
+	headcount := func() Headcount {
+		w := httptest.NewRecorder()
+		s.headcount(w, &auth.AuthenticatedRequest{Request: *httptest.NewRequest("GET", "/api/headcount", nil)})
+		var count Headcount
+		if err := json.NewDecoder(w.Body).Decode(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	if w, resp := checkIn("POST", "", ticket.ID, ""); w.Code != 404 || resp.Code != "invalid_ticket_token" {
+		t.Errorf("unsigned ticket ID = %d %+v", w.Code, resp)
+	}
+	if w, resp := checkIn("POST", workshop.Slug, token, ""); w.Code != 400 || resp.Code != "wrong_event" {
+		t.Errorf("ticket for another event = %d %+v", w.Code, resp)
+	}
+	if w, _ := checkIn("POST", "", token, `{"By": "door-2"}`); w.Code != 200 {
+		t.Fatalf("check in = %d: %s", w.Code, w.Body)
+	}
+	w, resp := checkIn("POST", event.Slug, token, "")
+	if w.Code != 409 || resp.Code != "already_checked_in" || !strings.HasSuffix(resp.Message, "by door-2.") {
+		t.Errorf("second check in = %d %+v", w.Code, resp)
+	}
+	if count := headcount(); count.Tickets != 1 || count.CheckedIn != 1 || count.ByDoor["door-2"] != 1 {
+		t.Errorf("headcount = %+v", count)
+	}
+
+	if w, _ := checkIn("DELETE", "", token, ""); w.Code != 200 {
+		t.Fatalf("undo check in = %d: %s", w.Code, w.Body)
+	}
+	if count := headcount(); count.CheckedIn != 0 {
+		t.Errorf("headcount after undo = %+v", count)
+	}
+	if w, _ := checkIn("POST", "", token, ""); w.Code != 200 {
+		t.Fatalf("check in after undo = %d: %s", w.Code, w.Body)
+	}
+	var saved models.Ticket
+	s.db.Where("id = ?", ticket.ID).First(&saved)
+	if saved.CheckedInAt == nil || saved.CheckedInBy != "admin" {
+		t.Errorf("checked in ticket = %+v", saved)
+	}
+}
+
+func TestTicketTokens(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	ticket := newTicket("Ada", "Lovelace", "6045551234", "ada@example.com", 1)
+	ticket.EventID = testEvent(t, s).ID
+	if err := s.db.Create(&ticket).Error; err != nil {
+		t.Fatal(err)
+	}
+	view := func(token string) int {
+		r := mux.SetURLVars(httptest.NewRequest("GET", "/", nil), map[string]string{"token": token})
+		w := httptest.NewRecorder()
+		s.ticket(w, r)
+		return w.Code
+	}
+
+	token := s.signer.sign(&ticket)
+	if code := view(token); code != 200 {
+		t.Errorf("view with a signed token = %d; not 200", code)
+	}
+	parts := strings.Split(token, ".")
+	forged := strings.Join(append([]string{parts[0], "some-other-ticket"}, parts[2:]...), ".")
+	for _, bad := range []string{ticket.ID, forged, token + "x", "other" + token} {
+		if code := view(bad); code != 404 {
+			t.Errorf("view with %q = %d; not 404", bad, code)
+		}
+	}
+
+	// Rotating in a new key keeps the old tokens working until the old key is
+	// removed.
+	old := s.signer.keys[0]
+	s.signer.keys = []ticketKey{{ID: "new", Secret: []byte("newer secret")}, old}
+	if code := view(token); code != 200 {
+		t.Errorf("view with a token from the old key = %d; not 200", code)
+	}
+	if newToken := s.signer.sign(&ticket); !strings.HasPrefix(newToken, "new.") || view(newToken) != 200 {
+		t.Errorf("token from the new key %q doesn't verify", newToken)
+	}
+	s.signer.keys = s.signer.keys[:1]
+	if code := view(token); code != 404 {
+		t.Errorf("view with a token from a removed key = %d; not 404", code)
+	}
+
+	// Old unsigned links keep working for a while, but only for tickets
+	// issued before signed links.
+	newer := newTicket("Grace", "Hopper", "6045551234", "grace@example.com", 1)
+	newer.EventID = ticket.EventID
+	if err := s.db.Create(&newer).Error; err != nil {
+		t.Fatal(err)
+	}
+	s.db.Model(&ticket).UpdateColumn("created_at", time.Now().Add(-48*time.Hour))
+	s.signer.legacyBefore = time.Now().Add(-24 * time.Hour)
+	s.signer.legacyUntil = time.Now().Add(24 * time.Hour)
+	if code := view(ticket.ID); code != 200 {
+		t.Errorf("view with a legacy ID = %d; not 200", code)
+	}
+	if code := view(newer.ID); code != 404 {
+		t.Errorf("view of a new ticket by its ID = %d; not 404", code)
+	}
+	// Door staff always scan signed QR codes, so a guessed ID can't be
+	// checked in.
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/tickets/"+ticket.ID+"/checkin", nil)
+	s.checkIn(w, &auth.AuthenticatedRequest{Request: *mux.SetURLVars(r, map[string]string{"token": ticket.ID}), Username: "door"})
+	if w.Code != 404 {
+		t.Errorf("check in with a legacy ID = %d; not 404", w.Code)
+	}
+	now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+	defer func() { now = time.Now }()
+	if code := view(ticket.ID); code != 404 {
+		t.Errorf("view with a legacy ID after the transition = %d; not 404", code)
+	}
+
+	if _, err := newTicketSigner(""); err == nil {
+		t.Error("newTicketSigner without keys didn't fail")
+	}
+	*debug = true
+	defer func() { *debug = false }()
+	if ts, err := newTicketSigner(""); err != nil {
+		t.Errorf("newTicketSigner without keys in debug mode: %s", err)
+	} else if !ts.legacyUntil.IsZero() {
+		t.Errorf("legacy links accepted until %s; they should be off unless enabled", ts.legacyUntil)
+	}
+
+	if _, err := parseTicketKeys("a:1, b:2"); err != nil {
+		t.Error(err)
+	}
+	for _, bad := range []string{"nosecret", ":secret", "a.b:secret"} {
+		if _, err := parseTicketKeys(bad); err == nil {
+			t.Errorf("parseTicketKeys(%q) didn't fail", bad)
+		}
+	}
+}
+
+func TestTicketQRCode(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	pr := models.PurchaseRequest{
+		EventID:   testEvent(t, s).ID,
+		FirstName: "Ada",
+		LastName:  "Lovelace",
+		Email:     "ada@example.com",
+		Type:      models.Individual,
+	}
+	if err := s.createRequestAndInvoice(&pr); err != nil {
+		t.Fatal(err)
+	}
+	var inline []email.File
+	var body string
+	sendEmail = func(to, subj, html string, files ...email.File) error {
+		body = html
+		inline = nil
+		for _, f := range files {
+			if f.Inline {
+				inline = append(inline, f)
+			}
+		}
+		return nil
+	}
+	payments.invoices[0].State = "PAID"
+	s.checkInvoices()
+	if len(inline) != 1 || !strings.Contains(body, `src="cid:`+inline[0].Name+`"`) {
+		t.Fatalf("email %q has inline images %v", body, inline)
+	}
+	if _, err := png.Decode(bytes.NewReader(inline[0].Data)); err != nil {
+		t.Fatalf("inline QR code: %s", err)
+	}
+
+	var ticket models.Ticket
+	s.db.First(&ticket)
+	token := s.signer.sign(&ticket)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w := get("/api/ticket/" + token + "/qr.png?size=100")
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("qr.png = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	img, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Dx(); size != 100 {
+		t.Errorf("qr.png is %d pixels wide; not 100", size)
+	}
+	w = get("/api/ticket/" + token + "/qr.svg")
+	if w.Code != 200 || !strings.HasPrefix(w.Body.String(), "<svg") {
+		t.Errorf("qr.svg = %d %s", w.Code, w.Body)
+	}
+	if w := get("/api/ticket/" + token + "/qr.png?size=99999"); w.Code != 400 {
+		t.Errorf("huge qr.png = %d; not 400", w.Code)
+	}
+	if w := get("/api/ticket/" + ticket.ID + "/qr.png"); w.Code != 404 {
+		t.Errorf("qr.png for an unsigned ID = %d; not 404", w.Code)
+	}
+}
+
+func TestTicketPDF(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	pr := models.PurchaseRequest{
+		EventID:   testEvent(t, s).ID,
+		FirstName: "Zoë",
+		LastName:  "Lovelace",
+		Email:     "zoe@example.com",
+		Type:      models.Individual,
+	}
+	if err := s.createRequestAndInvoice(&pr); err != nil {
+		t.Fatal(err)
+	}
+	var attached []email.File
+	sendEmail = func(to, subj, html string, files ...email.File) error {
+		attached = nil
+		for _, f := range files {
+			if !f.Inline {
+				attached = append(attached, f)
+			}
+		}
+		return nil
+	}
+	payments.invoices[0].State = "PAID"
+	s.checkInvoices()
+
+	var ticket models.Ticket
+	s.db.First(&ticket)
+	if len(attached) != 1 || attached[0].Name != "ticket-"+ticket.ID+".pdf" || !bytes.HasPrefix(attached[0].Data, []byte("%PDF")) {
+		t.Fatalf("email attachments = %+v", attached)
+	}
+
+	token := s.signer.sign(&ticket)
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/ticket/"+token+".pdf", nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/pdf" || !bytes.HasPrefix(w.Body.Bytes(), []byte("%PDF")) {
+		t.Fatalf("ticket pdf = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/ticket/"+token, nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("ticket = %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/ticket/"+ticket.ID+".pdf", nil))
+	if w.Code != 404 {
+		t.Errorf("pdf for an unsigned ID = %d; not 404", w.Code)
+	}
+}
+
+// writeTestPEM writes a PEM block to a file in dir and returns its path.
+func writeTestPEM(t *testing.T, dir, name, typ string, der []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testWalletCerts makes a self-signed stand in for Apple's WWDR certificate
+// and a pass certificate signed by it, returning their paths and the pool to
+// verify signatures with.
+func testWalletCerts(t *testing.T, dir string) (cert, key, wwdr string, roots *x509.CertPool) {
+	caKey, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test WWDR"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDER, err := x509.CreateCertificate(cryptorand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passKey, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Pass Type ID: pass.org.ubccsss.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	passDER, err := x509.CreateCertificate(cryptorand.Reader, passTemplate, ca, &passKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(passKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots = x509.NewCertPool()
+	roots.AddCert(ca)
+	return writeTestPEM(t, dir, "pass.pem", "CERTIFICATE", passDER),
+		writeTestPEM(t, dir, "pass.key", "PRIVATE KEY", keyDER),
+		writeTestPEM(t, dir, "wwdr.pem", "CERTIFICATE", caDER),
+		roots
+}
+
+func TestWalletPasses(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	dir, err := ioutil.TempDir("", "wallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range []*string{passTypeID, passTeamID, passCert, passKey, passWWDR, passImages, googleWalletIssuer, googleWalletKey} {
+		defer func(f *string, v string) { *f = v }(f, *f)
+	}
+	var roots *x509.CertPool
+	*passCert, *passKey, *passWWDR, roots = testWalletCerts(t, dir)
+	*passTypeID = "pass.org.ubccsss.test"
+	*passTeamID = "TEAM123456"
+	*passImages = filepath.Join(dir, "images")
+
+	googleKey, err := rsa.GenerateKey(cryptorand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := json.Marshal(serviceAccountKey{
+		ClientEmail: "tickets@example.iam.gserviceaccount.com",
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(googleKey)})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	*googleWalletIssuer = "3388000000000000000"
+	*googleWalletKey = filepath.Join(dir, "service-account.json")
+	if err := ioutil.WriteFile(*googleWalletKey, account, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without any configuration wallets are turned off.
+	event := testEvent(t, s)
+	ticket := models.Ticket{ID: "test-ticket", EventID: event.ID, FirstName: "Ada", LastName: "Lovelace"}
+	if err := s.db.Create(&ticket).Error; err != nil {
+		t.Fatal(err)
+	}
+	token := s.signer.sign(&ticket)
+	w := httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/ticket/"+token+".pkpass", nil))
+	if w.Code != 404 {
+		t.Errorf("pkpass without certs = %d; not 404", w.Code)
+	}
+
+	if s.passes, err = newPassSigner(); err != nil {
+		t.Fatal(err)
+	}
+	if s.googleWallet, err = newGoogleWallet(); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/ticket/"+token, nil))
+	var resp TicketResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.AppleWalletURL != "/api/ticket/"+token+".pkpass" || resp.GoogleWalletURL != "/api/ticket/"+token+"/googleWallet" {
+		t.Errorf("wallet links = %q %q", resp.AppleWalletURL, resp.GoogleWalletURL)
+	}
+
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", resp.AppleWalletURL, nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/vnd.apple.pkpass" {
+		t.Fatalf("pkpass = %d %s", w.Code, w.Body.String())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"pass.json", "icon.png", "manifest.json", "signature"} {
+		if _, ok := files[name]; !ok {
+			t.Fatalf("pkpass is missing %s", name)
+		}
+	}
+
+	var manifest map[string]string
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest) != len(files)-2 {
+		t.Errorf("manifest = %v", manifest)
+	}
+	for name, sum := range manifest {
+		got := sha1.Sum(files[name])
+		if hex.EncodeToString(got[:]) != sum {
+			t.Errorf("manifest hash of %s = %s; not %x", name, sum, got)
+		}
+	}
+
+	p7, err := pkcs7.Parse(files["signature"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p7.Content) != 0 {
+		t.Error("signature isn't detached")
+	}
+	p7.Content = files["manifest.json"]
+	if err := p7.VerifyWithChain(roots); err != nil {
+		t.Errorf("signature doesn't verify: %s", err)
+	}
+	p7.Content = append(files["manifest.json"], ' ')
+	if err := p7.Verify(); err == nil {
+		t.Error("signature verifies a different manifest")
+	}
+
+	var pass passJSON
+	if err := json.Unmarshal(files["pass.json"], &pass); err != nil {
+		t.Fatal(err)
+	}
+	if pass.PassTypeIdentifier != *passTypeID || pass.TeamIdentifier != *passTeamID || pass.SerialNumber != ticket.ID {
+		t.Errorf("pass ids = %+v", pass)
+	}
+	if len(pass.Barcodes) != 1 || pass.Barcodes[0].Message != ticket.URL(token) || pass.Barcodes[0].Format != "PKBarcodeFormatQR" {
+		t.Errorf("pass barcodes = %+v", pass.Barcodes)
+	}
+	if pass.EventTicket.PrimaryFields[0].Value != event.Name || pass.EventTicket.SecondaryFields[0].Value != "Ada Lovelace" {
+		t.Errorf("pass fields = %+v", pass.EventTicket)
+	}
+
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", resp.GoogleWalletURL, nil))
+	location := w.Header().Get("Location")
+	if w.Code != 302 || !strings.HasPrefix(location, "https://pay.google.com/gp/v/save/") {
+		t.Fatalf("google wallet = %d %s", w.Code, location)
+	}
+	parts := strings.Split(strings.TrimPrefix(location, "https://pay.google.com/gp/v/save/"), ".")
+	if len(parts) != 3 {
+		t.Fatalf("google wallet jwt = %q", location)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&googleKey.PublicKey, crypto.SHA256, sum[:], sig); err != nil {
+		t.Errorf("google wallet jwt signature: %s", err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var claims struct {
+		Iss, Aud, Typ string
+		Payload       struct {
+			EventTicketClasses []struct{ ID string }
+			EventTicketObjects []struct {
+				ID, ClassID, TicketHolderName string
+				Barcode                       struct{ Type, Value string }
+			}
+		}
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Iss != "tickets@example.iam.gserviceaccount.com" || claims.Aud != "google" || claims.Typ != "savetowallet" {
+		t.Errorf("google wallet claims = %+v", claims)
+	}
+	objects := claims.Payload.EventTicketObjects
+	if len(objects) != 1 || len(claims.Payload.EventTicketClasses) != 1 ||
+		objects[0].ID != *googleWalletIssuer+".ticket-test-ticket" ||
+		objects[0].ClassID != claims.Payload.EventTicketClasses[0].ID ||
+		objects[0].TicketHolderName != "Ada Lovelace" ||
+		objects[0].Barcode.Type != "QR_CODE" || objects[0].Barcode.Value != ticket.URL(token) {
+		t.Errorf("google wallet payload = %+v", claims.Payload)
+	}
+}
+
+func TestTicketTransfer(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	event := testEvent(t, s)
+	s.db.Model(event).UpdateColumn("max_transfers", 1)
+	ticket := models.Ticket{ID: "old-ticket", EventID: event.ID, FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}
+	other := models.Ticket{ID: "other-ticket", EventID: event.ID, FirstName: "Alan", LastName: "Turing", Email: "alan@example.com"}
+	for _, tk := range []*models.Ticket{&ticket, &other} {
+		if err := s.db.Create(tk).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	type sent struct{ to, body string }
+	var emails []sent
+	sendEmail = func(to, subj, body string, files ...email.File) error {
+		emails = append(emails, sent{to, body})
+		return nil
+	}
+	transfer := func(token, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("POST", "/api/ticket/"+token+"/transfer", strings.NewReader(body)))
+		return w
+	}
+	errCode := func(w *httptest.ResponseRecorder) string {
+		var resp ErrorResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Code
+	}
+
+	oldToken := s.signer.sign(&ticket)
+	if w := transfer(oldToken, `{"FirstName": "Grace", "LastName": "Hopper", "Email": "alan@example.com"}`); w.Code != 400 || errCode(w) != "invalid_fields" {
+		t.Errorf("transfer to a ticket holder = %d", w.Code)
+	}
+	if w := transfer(oldToken, `{"FirstName": "Grace", "Email": "grace@example.com"}`); w.Code != 400 {
+		t.Errorf("transfer without a last name = %d", w.Code)
+	}
+	w := transfer(oldToken, `{"FirstName": "Grace", "LastName": "Hopper", "Email": "grace@example.com"}`)
+	if w.Code != 200 {
+		t.Fatalf("transfer = %d %s", w.Code, w.Body.String())
+	}
+	var pending models.TicketTransfer
+	if err := s.db.First(&pending).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(emails) != 1 || emails[0].to != "ada@example.com" || !strings.Contains(emails[0].body, pending.ConfirmURL()) {
+		t.Fatalf("confirmation emails = %+v", emails)
+	}
+	// Nothing changes until the holder confirms.
+	if _, err := s.ticketByToken(oldToken); err != nil {
+		t.Fatalf("ticket before confirming: %s", err)
+	}
+
+	confirm := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("POST", "/api/transfers/"+token, nil))
+		return w
+	}
+	if w := confirm("bogus"); w.Code != 404 {
+		t.Errorf("confirm unknown transfer = %d; not 404", w.Code)
+	}
+	if w := confirm(pending.ConfirmToken); w.Code != 200 {
+		t.Fatalf("confirm = %d %s", w.Code, w.Body.String())
+	}
+	if w := confirm(pending.ConfirmToken); w.Code != 400 || errCode(w) != "transfer_used" {
+		t.Errorf("confirm twice = %d", w.Code)
+	}
+
+	if _, err := s.ticketByToken(oldToken); err != errBadToken {
+		t.Errorf("old token after transfer = %v; not revoked", err)
+	}
+	var tickets []models.Ticket
+	s.db.Where("event_id = ?", event.ID).Order("id").Find(&tickets)
+	if len(tickets) != 2 {
+		t.Fatalf("tickets after transfer = %+v", tickets)
+	}
+	reissued := tickets[0]
+	if reissued.ID == other.ID {
+		reissued = tickets[1]
+	}
+	if reissued.ID == ticket.ID || reissued.Email != "grace@example.com" || reissued.FirstName != "Grace" || reissued.Transfers != 1 {
+		t.Errorf("reissued ticket = %+v", reissued)
+	}
+	if len(emails) != 2 || emails[1].to != "grace@example.com" || !strings.Contains(emails[1].body, "Ada Lovelace transferred") {
+		t.Errorf("new holder emails = %+v", emails)
+	}
+
+	// The event allows one transfer per ticket.
+	if w := transfer(s.signer.sign(&reissued), `{"FirstName": "Linus", "LastName": "T", "Email": "linus@example.com"}`); w.Code != 400 || errCode(w) != "transfer_limit" {
+		t.Errorf("transfer past the limit = %d", w.Code)
+	}
+	checkedIn := time.Now()
+	s.db.Model(&other).UpdateColumn("checked_in_at", &checkedIn)
+	if w := transfer(s.signer.sign(&other), `{"FirstName": "Linus", "LastName": "T", "Email": "linus@example.com"}`); w.Code != 400 || errCode(w) != "already_checked_in" {
+		t.Errorf("transfer of a used ticket = %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.transfers(w, &auth.AuthenticatedRequest{Request: *httptest.NewRequest("GET", "/api/transfers", nil)})
+	var history []models.TicketTransfer
+	if err := json.NewDecoder(w.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].TicketID != ticket.ID || history[0].NewTicketID != reissued.ID || history[0].ConfirmedAt == nil {
+		t.Errorf("transfer history = %+v", history)
+	}
+}
+
+func TestTicketTransferLimits(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	event := testEvent(t, s)
+	ticket := models.Ticket{ID: "old-ticket", EventID: event.ID, FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"}
+	if err := s.db.Create(&ticket).Error; err != nil {
+		t.Fatal(err)
+	}
+	pr := models.PurchaseRequest{EventID: event.ID, FirstName: "Grace", LastName: "Hopper", Email: "grace@example.com", Type: models.Individual}
+	if err := s.createRequestAndInvoice(&pr); err != nil {
+		t.Fatal(err)
+	}
+	var sent int
+	sendEmail = func(to, subj, body string, files ...email.File) error {
+		sent++
+		return nil
+	}
+	token := s.signer.sign(&ticket)
+	transfer := func(email string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := `{"FirstName": "New", "LastName": "Holder", "Email": "` + email + `"}`
+		s.routes().ServeHTTP(w, httptest.NewRequest("POST", "/api/ticket/"+token+"/transfer", strings.NewReader(body)))
+		return w
+	}
+
+	if w := transfer("Grace@example.com"); w.Code != 400 || !strings.Contains(w.Body.String(), "pending_purchase") {
+		t.Errorf("transfer to someone waiting on payment = %d %s", w.Code, w.Body)
+	}
+	for i := 0; i < 3; i++ {
+		if w := transfer(fmt.Sprintf("new%d@example.com", i)); w.Code != 200 {
+			t.Fatalf("transfer = %d %s", w.Code, w.Body)
+		}
+	}
+	if w := transfer("new3@example.com"); w.Code != 429 {
+		t.Errorf("transfer past the limit = %d; not 429", w.Code)
+	}
+	if sent != 3 {
+		t.Errorf("holder emailed %d times; not 3", sent)
+	}
+}
+
+func TestResend(t *testing.T) {
+	s, payments, cleanup := newTestServer(t)
+	defer cleanup()
+
+	pr := models.PurchaseRequest{
+		EventID:   testEvent(t, s).ID,
+		FirstName: "Ada",
+		LastName:  "Lovelace",
+		Email:     "ada@example.com",
+		Type:      models.Individual,
+	}
+	if err := s.createRequestAndInvoice(&pr); err != nil {
+		t.Fatal(err)
+	}
+	resend := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.resend(w, &auth.AuthenticatedRequest{Request: *httptest.NewRequest("POST", "/api/resend", strings.NewReader(body))})
+		return w
+	}
+	if w := resend(fmt.Sprintf(`{"PurchaseRequestID": %d}`, pr.ID)); w.Code != 400 {
+		t.Errorf("resend unpaid purchase = %d; not 400", w.Code)
+	}
+
+	// The first email fails, as if Mailgun were down.
+	var sentTo []string
+	sendEmail = func(to, subj, body string, files ...email.File) error {
+		return errors.New("mailgun down")
+	}
+	payments.invoices[0].State = "PAID"
+	s.checkInvoices()
+	var ticket models.Ticket
+	if err := s.db.First(&ticket).Error; err != nil {
+		t.Fatal(err)
+	}
+	if w := resend(`{"TicketIDs": ["` + ticket.ID + `"]}`); w.Code != 503 {
+		t.Errorf("resend while mail is down = %d; not 503", w.Code)
+	}
+
+	sendEmail = func(to, subj, body string, files ...email.File) error {
+		if !strings.Contains(body, "/ticket/") {
+			t.Errorf("resent email to %s has no ticket link: %s", to, body)
+		}
+		sentTo = append(sentTo, to)
+		return nil
+	}
+	if w := resend(fmt.Sprintf(`{"PurchaseRequestID": %d}`, pr.ID)); w.Code != 200 {
+		t.Fatalf("resend purchase = %d %s", w.Code, w.Body.String())
+	}
+	if w := resend(`{"TicketIDs": ["` + ticket.ID + `"]}`); w.Code != 200 {
+		t.Fatalf("resend ticket = %d %s", w.Code, w.Body.String())
+	}
+	if !reflect.DeepEqual(sentTo, []string{"ada@example.com", "ada@example.com"}) {
+		t.Errorf("resent to %v", sentTo)
+	}
+	if w := resend(`{"TicketIDs": ["nope"]}`); w.Code != 404 {
+		t.Errorf("resend unknown ticket = %d; not 404", w.Code)
+	}
+}
+
+func TestTicketLookup(t *testing.T) {
+	s, _, cleanup := newTestServer(t)
+	defer cleanup()
+
+	event := testEvent(t, s)
+	pr := models.PurchaseRequest{EventID: event.ID, FirstName: "Ada", Email: "ada@example.com", Type: models.Group}
+	if err := s.db.Create(&pr).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, ticket := range []models.Ticket{
+		{ID: "ada-ticket", EventID: event.ID, PurchaseRequestID: pr.ID, FirstName: "Ada", Email: "Ada@Example.com"},
+		{ID: "friend-ticket", EventID: event.ID, PurchaseRequestID: pr.ID, FirstName: "Friend", Email: "friend@example.com"},
+		{ID: "other-ticket", EventID: event.ID, FirstName: "Other", Email: "other@example.com"},
+	} {
+		if err := s.db.Create(&ticket).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	var link string
+	var emailed int
+	sendEmail = func(to, subj, body string, files ...email.File) error {
+		emailed++
+		link = body[strings.Index(body, lookupURL("")):]
+		link = link[:strings.Index(link, `"`)]
+		return nil
+	}
+	lookup := func(ip, addr string) (*httptest.ResponseRecorder, LookupResponse) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/tickets/lookup", strings.NewReader(`{"Email": "`+addr+`"}`))
+		r.RemoteAddr = ip + ":1234"
+		s.routes().ServeHTTP(w, r)
+		s.background.Wait()
+		var resp LookupResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w, resp
+	}
+
+	w, found := lookup("10.0.0.1", " ADA@example.com")
+	if w.Code != 200 || emailed != 1 {
+		t.Fatalf("lookup = %d, %d emails", w.Code, emailed)
+	}
+	// Addresses without tickets get the same answer and no email.
+	w, missing := lookup("10.0.0.1", "nobody@example.com")
+	if w.Code != 200 || emailed != 1 || strings.Replace(missing.Message, "nobody", "ada", 1) != found.Message {
+		t.Errorf("lookup without tickets = %d %q, %d emails", w.Code, missing.Message, emailed)
+	}
+	if w, _ := lookup("10.0.0.1", "not an email"); w.Code != 400 {
+		t.Errorf("lookup of a bad address = %d; not 400", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/tickets/lookup/"+strings.TrimPrefix(link, lookupURL("")), nil))
+	var tickets []LookupTicket
+	if err := json.NewDecoder(w.Body).Decode(&tickets); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, ticket := range tickets {
+		ids = append(ids, ticket.ID)
+		if got, err := s.ticketByToken(ticket.Token); err != nil || got.ID != ticket.ID {
+			t.Errorf("token of %s = %v, %v", ticket.ID, got, err)
+		}
+		if ticket.Event.Slug != event.Slug {
+			t.Errorf("event of %s = %+v", ticket.ID, ticket.Event)
+		}
+	}
+	// The buyer sees the tickets they bought for others too, unless they were
+	// transferred to someone else.
+	if !reflect.DeepEqual(ids, []string{"ada-ticket", "friend-ticket"}) {
+		t.Errorf("looked up tickets = %v", ids)
+	}
+	transferred := models.Ticket{ID: "transferred-ticket", EventID: event.ID, PurchaseRequestID: pr.ID, FirstName: "Stranger", Email: "stranger@example.com", Transfers: 1}
+	if err := s.db.Create(&transferred).Error; err != nil {
+		t.Fatal(err)
+	}
+	if tickets, err := s.ticketsFor("ada@example.com"); err != nil || len(tickets) != 2 {
+		t.Errorf("tickets after transfer = %d, %v; the transferred ticket shouldn't be listed", len(tickets), err)
+	}
+
+	for _, token := range []string{"bogus", strings.TrimPrefix(link, lookupURL("")) + "x", s.signer.sign(&models.Ticket{ID: "ada-ticket", EventID: event.ID})} {
+		w = httptest.NewRecorder()
+		s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/tickets/lookup/"+token, nil))
+		if w.Code != 404 {
+			t.Errorf("lookup with token %q = %d; not 404", token, w.Code)
+		}
+	}
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Now().Add(lookupExpiry + time.Minute) }
+	w = httptest.NewRecorder()
+	s.routes().ServeHTTP(w, httptest.NewRequest("GET", "/api/tickets/lookup/"+strings.TrimPrefix(link, lookupURL("")), nil))
+	if w.Code != 404 {
+		t.Errorf("expired lookup = %d; not 404", w.Code)
+	}
+
+	// Each address only gets a few emails an hour, but lookups that don't
+	// send one don't count.
+	now = time.Now
+	for i := 0; i < 5; i++ {
+		lookup(fmt.Sprintf("10.0.3.%d", i), "nobody@example.com")
+	}
+	for i := 0; i < 4; i++ {
+		lookup(fmt.Sprintf("10.0.1.%d", i), "ada@example.com")
+	}
+	if emailed != 5 {
+		t.Errorf("%d lookup emails; not 5", emailed)
+	}
+	if w, _ := lookup("10.0.2.1", "ada@example.com"); w.Code != 200 || emailed != 5 {
+		t.Errorf("lookup past the address limit = %d, %d emails; want 200 and no email", w.Code, emailed)
+	}
+	for i := 0; i < 3; i++ {
+		lookup("10.0.0.1", fmt.Sprintf("person%d@example.com", i))
+	}
+	if w, _ := lookup("10.0.0.1", "someone@example.com"); w.Code != 429 {
+		t.Errorf("lookup past the IP limit = %d; not 429", w.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func() { *trustProxy = false }()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Add("X-Forwarded-For", "1.2.3.4, 5.6.7.8")
+	r.Header.Add("X-Forwarded-For", "9.9.9.9")
+	if ip := clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("clientIP = %q; not the remote address", ip)
+	}
+	*trustProxy = true
+	if ip := clientIP(r); ip != "9.9.9.9" {
+		t.Errorf("clientIP behind a proxy = %q; not the address it added", ip)
+	}
+	r.Header.Del("X-Forwarded-For")
+	if ip := clientIP(r); ip != "10.0.0.1" {
+		t.Errorf("clientIP without X-Forwarded-For = %q", ip)
+	}
+}
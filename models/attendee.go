@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// Attendee is one person a purchase request buys a ticket for. A purchase
+// request has one attendee per seat, usually starting with the buyer.
+type Attendee struct {
+	ID                int
+	PurchaseRequestID int `gorm:"index"`
+	// Position orders the attendees of a purchase request from zero.
+	Position    int
+	FirstName   string
+	LastName    string
+	Email       string
+	PhoneNumber string
+	StudentID   string
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt *time.Time
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Event is something tickets are sold for. Purchase requests and tickets
+// belong to exactly one event.
+type Event struct {
+	ID       int
+	Slug     string `valid:"required" gorm:"unique_index"`
+	Name     string `valid:"required"`
+	Date     time.Time
+	Venue    string
+	Capacity int
+	// MaxTransfers is how many times each ticket can be passed on by its
+	// holder, or zero for no limit. Negative turns transfers off.
+	MaxTransfers int
+
+	// InvoicePrefix starts the Square merchant invoice number of every
+	// purchase request for this event, e.g. "PurchaseRequest2018 12".
+	InvoicePrefix string `valid:"required"`
+
+	// EmailIntro and EmailSignoff are the HTML before and after the ticket
+	// links in the email sent once an invoice is paid.
+	EmailIntro   string
+	EmailSignoff string
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt *time.Time
+}
+
+// InvoiceReference returns the merchant invoice number for a purchase request
+// of this event.
+func (e Event) InvoiceReference(purchaseRequestID int) string {
+	return fmt.Sprintf("%s %d", e.InvoicePrefix, purchaseRequestID)
+}
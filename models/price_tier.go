@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// PriceTier is a price for a ticket type during a window of time, e.g. early
+// bird pricing. When a ticket type has several tiers the first active one
+// applies.
+type PriceTier struct {
+	ID           int
+	TicketTypeID int    `gorm:"index"`
+	Name         string `valid:"required"`
+	Price        float64
+
+	// StartsAt and EndsAt bound the tier. Either may be nil for an open end.
+	StartsAt *time.Time
+	EndsAt   *time.Time
+	// MaxSales ends the tier early once this many purchase requests have been
+	// made at its price. Zero means no limit.
+	MaxSales int
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt *time.Time
+}
+
+// InWindow reports whether t falls between StartsAt and EndsAt.
+func (p PriceTier) InWindow(t time.Time) bool {
+	if p.StartsAt != nil && t.Before(*p.StartsAt) {
+		return false
+	}
+	if p.EndsAt != nil && !t.Before(*p.EndsAt) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Reservation holds seats for a purchase request while its invoice is
+// unpaid, so outstanding invoices count against an event's capacity.
+type Reservation struct {
+	ID                int
+	EventID           int `gorm:"index"`
+	TicketTypeID      int `gorm:"index"`
+	PurchaseRequestID int `gorm:"index"`
+	Seats             int
+
+	// WaitlistEntryID is set instead of PurchaseRequestID for seats offered
+	// to someone on the waitlist, which are only held until ExpiresAt.
+	WaitlistEntryID int `gorm:"index"`
+	ExpiresAt       *time.Time
+
+	// ReleasedAt is set once the seats are no longer held, because tickets
+	// were issued for them or the invoice was canceled.
+	ReleasedAt *time.Time
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
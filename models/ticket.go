@@ -3,37 +3,44 @@ package models
 import (
 	"fmt"
 	"time"
-
-	"github.com/ubccsss/square-invoice-tickets/square"
 )
 
 type PurchaseRequest struct {
 	ID          int
+	EventID     int    `gorm:"index"`
 	FirstName   string `valid:"required"`
 	LastName    string `valid:"required"`
-	StudentID   string `valid:"required"`
+	StudentID   string
 	Email       string `valid:"required,email"`
 	PhoneNumber string `valid:"required"`
 	RawType     string `valid:"required"`
-	Type        string
-
-	Status  string
-	Invoice *square.Invoice
-
-	GroupMember2FirstName   string
-	GroupMember2LastName    string
-	GroupMember2Email       string
-	GroupMember2PhoneNumber string
-
-	GroupMember3FirstName   string
-	GroupMember3LastName    string
-	GroupMember3Email       string
-	GroupMember3PhoneNumber string
-
-	GroupMember4FirstName   string
-	GroupMember4LastName    string
-	GroupMember4Email       string
-	GroupMember4PhoneNumber string
+	// Type is the name of the ticket type, kept alongside TicketTypeID for
+	// display and for requests from before ticket types existed.
+	Type         string
+	TicketTypeID int
+	// PriceTierID is the price tier Charged was locked in at, or zero if the
+	// ticket type had no active tier.
+	PriceTierID int
+
+	Status string `gorm:"-"`
+
+	// InvoiceToken is the token of the Square invoice sent for this request.
+	// It is empty until Square has confirmed the invoice exists.
+	InvoiceToken string
+	// InvoiceState and DeliveryStatus mirror the Square invoice. They are
+	// kept up to date by the poller and webhook.
+	InvoiceState   string
+	DeliveryStatus string
+	// InvoiceUpdatedAt is when Square last changed the invoice as of
+	// InvoiceState, so updates that arrive out of order can be ignored.
+	InvoiceUpdatedAt *time.Time
+	PaidAt           *time.Time
+	CanceledAt       *time.Time
+	// InvoiceFailedAt is set when creating the invoice failed in a way that
+	// trying again won't fix, and InvoiceError says why. Failed requests are
+	// never retried and hold no seats.
+	InvoiceFailedAt *time.Time
+	InvoiceError    string
 
 	RawAfterPartyCount string
 	AfterPartyCount    int
@@ -44,7 +51,31 @@ type PurchaseRequest struct {
 	UpdatedAt time.Time
 	DeletedAt *time.Time
 
-	Tickets []Ticket
+	// Attendees are who the tickets are for, ordered by Position.
+	Attendees []Attendee
+	Tickets   []Ticket
+}
+
+// BuyerAttendee returns the buyer as an attendee.
+func (pr PurchaseRequest) BuyerAttendee() Attendee {
+	return Attendee{
+		FirstName:   pr.FirstName,
+		LastName:    pr.LastName,
+		Email:       pr.Email,
+		PhoneNumber: pr.PhoneNumber,
+		StudentID:   pr.StudentID,
+	}
+}
+
+// InvoiceStatus summarizes the Square invoice for display.
+func (pr PurchaseRequest) InvoiceStatus() string {
+	if pr.InvoiceFailedAt != nil {
+		return "FAILED - " + pr.InvoiceError
+	}
+	if len(pr.InvoiceToken) == 0 {
+		return "NO_INVOICE"
+	}
+	return pr.InvoiceState + " - " + pr.DeliveryStatus
 }
 
 type PromoCode struct {
@@ -58,6 +89,7 @@ type PromoCode struct {
 	DeletedAt *time.Time
 }
 
+// The ticket types created for the default event.
 const (
 	IndividualCS = "IndividualCS"
 	Individual   = "Individual"
@@ -66,20 +98,33 @@ const (
 
 type Ticket struct {
 	ID                string
+	EventID           int `gorm:"index"`
 	PurchaseRequestID int
 	FirstName         string
 	LastName          string
 	PhoneNumber       string
 	Email             string
 
+	// CheckedInAt is when the ticket was scanned at the door, and CheckedInBy
+	// is who scanned it.
+	CheckedInAt *time.Time
+	CheckedInBy string
+	// Transfers is how many times the ticket has changed hands.
+	Transfers int
+
+	// Token is a signed token for the ticket, only filled in for admins and
+	// for holders looking up their tickets.
+	Token string `gorm:"-"`
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt *time.Time
 }
 
-func (t Ticket) URL() string {
-	return "http://tickets.ubccsss.org/ticket/" + t.ID
+// URL is the link to the ticket given a signed token for it.
+func (t Ticket) URL(token string) string {
+	return "http://tickets.ubccsss.org/ticket/" + token
 }
-func (t Ticket) HTML() string {
-	return fmt.Sprintf(`%s %s <a href="%s">%s</a><br>`, t.FirstName, t.LastName, t.URL(), t.URL())
+func (t Ticket) HTML(token string) string {
+	return fmt.Sprintf(`%s %s <a href="%s">%s</a><br>`, t.FirstName, t.LastName, t.URL(token), t.URL(token))
 }
@@ -4,7 +4,7 @@ import "testing"
 
 func TestURL(t *testing.T) {
 	ticket := Ticket{ID: "test"}
-	out := ticket.URL()
+	out := ticket.URL("test")
 	want := "http://tickets.ubccsss.org/ticket/test"
 	if out != want {
 		t.Errorf("%+v.URL() = %s; not %s", t, out, want)
@@ -12,7 +12,7 @@ func TestURL(t *testing.T) {
 }
 func TestHTML(t *testing.T) {
 	ticket := Ticket{ID: "test", FirstName: "first", LastName: "last"}
-	out := ticket.HTML()
+	out := ticket.HTML("test")
 	want := `first last <a href="http://tickets.ubccsss.org/ticket/test">http://tickets.ubccsss.org/ticket/test</a><br>`
 	if out != want {
 		t.Errorf("%+v.URL() = %s; not %s", t, out, want)
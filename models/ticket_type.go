@@ -0,0 +1,48 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxSeats is the most tickets a single purchase request can hold, so one
+// invoice can't buy out an event.
+const MaxSeats = 10
+
+// TicketType is a kind of ticket sold for an event, e.g. a group of four or an
+// individual ticket for CS students.
+type TicketType struct {
+	ID      int
+	EventID int    `gorm:"index"`
+	Name    string `valid:"required"`
+
+	Price float64
+	// Seats is the number of tickets issued per purchase.
+	Seats int
+	// Cap limits the number of tickets of this type issued for the event. Zero
+	// means only the event's capacity applies.
+	Cap int
+
+	// PromoCodes is whether promo codes can discount this type.
+	PromoCodes bool
+	// RequireStudentID and EmailSuffix restrict who can buy this type.
+	RequireStudentID bool
+	EmailSuffix      string
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt *time.Time
+}
+
+// Eligible returns an error describing why pr can't buy this ticket type, or
+// nil if it can.
+func (t TicketType) Eligible(pr *PurchaseRequest) error {
+	if t.RequireStudentID && len(strings.TrimSpace(pr.StudentID)) == 0 {
+		return fmt.Errorf("%s tickets require a student ID", t.Name)
+	}
+	if len(t.EmailSuffix) > 0 && !strings.HasSuffix(strings.ToLower(pr.Email), strings.ToLower(t.EmailSuffix)) {
+		return fmt.Errorf("%s tickets require an email address ending in %s", t.Name, t.EmailSuffix)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEligible(t *testing.T) {
+	tt := TicketType{Name: "Faculty", RequireStudentID: true, EmailSuffix: "@cs.ubc.ca"}
+	cases := []struct {
+		pr PurchaseRequest
+		ok bool
+	}{
+		{PurchaseRequest{StudentID: "1", Email: "prof@CS.ubc.ca"}, true},
+		{PurchaseRequest{StudentID: " ", Email: "prof@cs.ubc.ca"}, false},
+		{PurchaseRequest{StudentID: "1", Email: "prof@example.com"}, false},
+	}
+	for _, c := range cases {
+		if err := tt.Eligible(&c.pr); (err == nil) != c.ok {
+			t.Errorf("Eligible(%+v) = %v; want ok %t", c.pr, err, c.ok)
+		}
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(24 * time.Hour)
+	tier := PriceTier{StartsAt: &start, EndsAt: &end}
+	cases := []struct {
+		t  time.Time
+		in bool
+	}{
+		{start.Add(-time.Second), false},
+		{start, true},
+		{end.Add(-time.Second), true},
+		{end, false},
+	}
+	for _, c := range cases {
+		if got := tier.InWindow(c.t); got != c.in {
+			t.Errorf("InWindow(%s) = %t; not %t", c.t, got, c.in)
+		}
+	}
+	if !(PriceTier{}).InWindow(start) {
+		t.Error("tier without a window should always be in it")
+	}
+}
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// TicketTransfer is a ticket holder passing their ticket on to someone else.
+// It takes effect when the holder confirms it from the link emailed to them,
+// at which point the ticket is reissued to the new holder under a new ID so
+// links to the old ticket stop working.
+type TicketTransfer struct {
+	ID      int
+	EventID int `gorm:"index"`
+	// TicketID is the ticket being transferred, and NewTicketID the ticket it
+	// was reissued as once confirmed.
+	TicketID    string `gorm:"index"`
+	NewTicketID string
+
+	FromFirstName string
+	FromLastName  string
+	FromEmail     string
+
+	FirstName   string `valid:"required"`
+	LastName    string `valid:"required"`
+	Email       string `valid:"required,email"`
+	PhoneNumber string
+
+	// ConfirmToken is the secret in the confirmation link.
+	ConfirmToken string `gorm:"index" json:"-"`
+	ExpiresAt    *time.Time
+	ConfirmedAt  *time.Time
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt *time.Time
+}
+
+// ConfirmURL is the link emailed to the holder to confirm the transfer.
+func (t TicketTransfer) ConfirmURL() string {
+	return "http://tickets.ubccsss.org/transfer/" + t.ConfirmToken
+}
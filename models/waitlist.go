@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// WaitlistEntry is someone waiting for a sold out ticket type. When seats
+// free up the next entry is offered them at a locked in price and has until
+// ExpiresAt to claim them.
+type WaitlistEntry struct {
+	ID           int
+	EventID      int `gorm:"index"`
+	TicketTypeID int
+	FirstName    string `valid:"required"`
+	LastName     string `valid:"required"`
+	Email        string `valid:"required,email"`
+
+	// Request is the JSON of the purchase request the buyer submitted, which
+	// is used as is when they claim their seats.
+	Request string `json:"-"`
+
+	// Price and PriceTierID are locked in when the buyer is invited.
+	Price       float64
+	PriceTierID int
+	// ClaimToken is the secret in the claim link, set when the buyer is
+	// invited.
+	ClaimToken string `gorm:"index" json:"-"`
+	InvitedAt  *time.Time
+	ExpiresAt  *time.Time
+	ClaimedAt  *time.Time
+	// InviteError is why the invite couldn't be emailed, in which case the
+	// entry expired right away so the next person could be invited.
+	InviteError string
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt *time.Time
+}
+
+// ClaimURL is the link emailed to the buyer when they are invited.
+func (e WaitlistEntry) ClaimURL() string {
+	return "http://tickets.ubccsss.org/claim/" + e.ClaimToken
+}
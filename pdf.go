@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jung-kurt/gofpdf"
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/models"
+)
+
+func ticketPDFName(ticket *models.Ticket) string {
+	return "ticket-" + ticket.ID + ".pdf"
+}
+
+// ticketTypeName returns the name of the ticket type a ticket was bought as,
+// or "" for tickets made by admins.
+func (s *server) ticketTypeName(ticket *models.Ticket) (string, error) {
+	if ticket.PurchaseRequestID == 0 {
+		return "", nil
+	}
+	var pr models.PurchaseRequest
+	if q := s.db.Unscoped().First(&pr, ticket.PurchaseRequestID); q.RecordNotFound() {
+		return "", nil
+	} else if q.Error != nil {
+		return "", errors.Wrap(q.Error, "db purchase request")
+	}
+	tt, err := s.purchaseTicketType(&pr)
+	if err != nil {
+		return pr.Type, nil
+	}
+	return tt.Name, nil
+}
+
+// ticketPDF renders a printable ticket with its QR code and token, for people
+// who would rather bring paper.
+func (s *server) ticketPDF(ticket *models.Ticket, token string) ([]byte, error) {
+	event, err := s.eventByID(ticket.EventID)
+	if err != nil {
+		return nil, err
+	}
+	typeName, err := s.ticketTypeName(ticket)
+	if err != nil {
+		return nil, err
+	}
+	qr, err := ticketQR(ticket, token)
+	if err != nil {
+		return nil, err
+	}
+	png, err := qr.PNG(defaultQRSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "qr png")
+	}
+
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetTitle(event.Name+" Ticket", true)
+	pdf.SetMargins(20, 20, 20)
+	pdf.AddPage()
+	// The core fonts are cp1252, so names need translating.
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	line := func(style string, size float64, text string) {
+		pdf.SetFont("Helvetica", style, size)
+		pdf.MultiCell(0, size/2, tr(text), "", "L", false)
+		pdf.Ln(2)
+	}
+
+	line("B", 24, event.Name)
+	if !event.Date.IsZero() {
+		line("", 14, event.Date.Format("Monday, January 2, 2006 at 3:04 PM"))
+	}
+	if len(event.Venue) > 0 {
+		line("", 14, event.Venue)
+	}
+	pdf.Ln(8)
+	line("B", 18, ticket.FirstName+" "+ticket.LastName)
+	if len(typeName) > 0 {
+		line("", 14, typeName+" ticket")
+	}
+
+	pdf.RegisterImageOptionsReader("qr", gofpdf.ImageOptions{ImageType: "PNG"}, bytes.NewReader(png))
+	pdf.Ln(4)
+	pdf.ImageOptions("qr", pdf.GetX(), 0, 80, 80, true, gofpdf.ImageOptions{ImageType: "PNG"}, 0, "")
+	pdf.Ln(4)
+	pdf.SetFont("Courier", "", 8)
+	pdf.MultiCell(0, 4, token, "", "L", false)
+	pdf.Ln(4)
+	line("", 10, "Show this page or the QR code at the door. Each ticket admits one person once.")
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, errors.Wrap(err, "pdf")
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *server) ticketPDFDownload(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	ticket, err := s.ticketByToken(token)
+	if err != nil {
+		s.ticketErr(w, err)
+		return
+	}
+	pdf, err := s.ticketPDF(ticket, token)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+ticketPDFName(ticket)+`"`)
+	w.Write(pdf)
+}
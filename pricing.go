@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/asaskevich/govalidator"
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/models"
+)
+
+// now is swapped out in tests.
+var now = time.Now
+
+// tierSales counts the purchase requests locked in at a tier, not counting
+// ones that were canceled, failed to invoice or were abandoned before being
+// invoiced, since those never took a sale.
+func (s *server) tierSales(tier *models.PriceTier) (int, error) {
+	count := 0
+	err := s.db.Model(&models.PurchaseRequest{}).
+		Where("price_tier_id = ? AND IFNULL(invoice_state, '') != ?", tier.ID, "CANCELED").
+		Where("canceled_at IS NULL AND invoice_failed_at IS NULL").
+		// The same cutoff releaseAbandoned gives up on them at.
+		Where("IFNULL(invoice_token, '') != '' OR paid_at IS NOT NULL OR created_at >= ?", now().Add(-24*time.Hour)).
+		Count(&count).Error
+	if err != nil {
+		return 0, errors.Wrap(err, "db tier sales")
+	}
+	return count, nil
+}
+
+// currentTier returns the first tier of tt that is in its window and hasn't
+// sold out, along with how many sales it has left, or nil if there is none.
+// Tiers are tried in order of their start time.
+func (s *server) currentTier(tt *models.TicketType) (*models.PriceTier, int, error) {
+	var tiers []*models.PriceTier
+	if err := s.db.Where("ticket_type_id = ?", tt.ID).
+		Order("starts_at IS NOT NULL, starts_at, id").Find(&tiers).Error; err != nil {
+		return nil, 0, errors.Wrap(err, "db price tiers")
+	}
+	t := now()
+	for _, tier := range tiers {
+		if !tier.InWindow(t) {
+			continue
+		}
+		if tier.MaxSales == 0 {
+			return tier, 0, nil
+		}
+		sales, err := s.tierSales(tier)
+		if err != nil {
+			return nil, 0, err
+		}
+		if sales < tier.MaxSales {
+			return tier, tier.MaxSales - sales, nil
+		}
+	}
+	return nil, 0, nil
+}
+
+// priceEstimate prices req at the current tier of tt and locks that tier in.
+// Only a quote unless s.seatsMu is held, since another buyer could take the
+// tier's last sale in the meantime.
+func (s *server) priceEstimate(tt *models.TicketType, req *models.PurchaseRequest) (float64, error) {
+	basePrice := tt.Price
+	req.PriceTierID = 0
+	tier, _, err := s.currentTier(tt)
+	if err != nil {
+		return 0, err
+	}
+	if tier != nil {
+		basePrice = tier.Price
+		req.PriceTierID = tier.ID
+	}
+	return s.applyPromoCode(tt, req, basePrice)
+}
+
+// applyPromoCode discounts basePrice by req's promo code if tt allows it.
+func (s *server) applyPromoCode(tt *models.TicketType, req *models.PurchaseRequest, basePrice float64) (float64, error) {
+	if !tt.PromoCodes {
+		return basePrice, nil
+	}
+
+	promoCode, err := s.getPromoCode(req.PromoCode)
+	if err != nil {
+		return 0, err
+	}
+
+	if promoCode != nil {
+		basePrice = basePrice*(1-promoCode.Percent) - promoCode.Amount
+	}
+
+	return basePrice, nil
+}
+
+// TierResponse describes the price tier currently on sale.
+type TierResponse struct {
+	Name   string
+	Price  float64
+	EndsAt *time.Time
+	// SalesLeft is how many more purchases can be made at this price, or nil
+	// if the tier only ends at EndsAt.
+	SalesLeft *int
+}
+
+func (s *server) tierResponse(tt *models.TicketType) (*TierResponse, error) {
+	tier, left, err := s.currentTier(tt)
+	if err != nil || tier == nil {
+		return nil, err
+	}
+	resp := &TierResponse{
+		Name:   tier.Name,
+		Price:  tier.Price,
+		EndsAt: tier.EndsAt,
+	}
+	if tier.MaxSales > 0 {
+		resp.SalesLeft = &left
+	}
+	return resp, nil
+}
+
+func (s *server) priceTiers(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	event, err := s.event(&r.Request)
+	if err != nil {
+		s.eventErr(w, err)
+		return
+	}
+	types, err := s.eventTicketTypes(event)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	var typeIDs []int
+	for _, tt := range types {
+		typeIDs = append(typeIDs, tt.ID)
+	}
+	ofEvent := func(id int) bool {
+		for _, typeID := range typeIDs {
+			if typeID == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch r.Method {
+	case "POST", "PATCH", "DELETE":
+		var req models.PriceTier
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.err(w, err, 400)
+			return
+		}
+		if r.Method != "POST" {
+			var existing models.PriceTier
+			if err := s.db.First(&existing, req.ID).Error; err != nil || !ofEvent(existing.TicketTypeID) {
+				s.err(w, fmt.Errorf("no price tier %d for %s", req.ID, event.Slug), 404)
+				return
+			}
+		}
+		if r.Method == "DELETE" {
+			err = s.db.Delete(&req).Error
+			break
+		}
+		if !ofEvent(req.TicketTypeID) {
+			s.err(w, fmt.Errorf("no ticket type %d for %s", req.TicketTypeID, event.Slug), 400)
+			return
+		}
+		if _, err := govalidator.ValidateStruct(req); err != nil {
+			s.err(w, err, 400)
+			return
+		}
+		if req.StartsAt != nil && req.EndsAt != nil && !req.EndsAt.After(*req.StartsAt) {
+			s.err(w, errors.New("EndsAt must be after StartsAt"), 400)
+			return
+		}
+		if r.Method == "POST" {
+			req.ID = 0
+			err = s.db.Create(&req).Error
+		} else {
+			err = s.db.Save(&req).Error
+		}
+	case "GET":
+	default:
+		s.err(w, fmt.Errorf("unknown method %s", r.Method), 400)
+		return
+	}
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+
+	var records []*models.PriceTier
+	if len(typeIDs) > 0 {
+		if err := s.db.Where("ticket_type_id IN (?)", typeIDs).
+			Order("ticket_type_id, starts_at IS NOT NULL, starts_at, id").Find(&records).Error; err != nil {
+			s.err(w, err, 500)
+			return
+		}
+	}
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ubccsss/square-invoice-tickets/email"
+	"github.com/ubccsss/square-invoice-tickets/square"
+)
+
+// PaymentProvider is the set of invoice operations the server needs from a
+// payment backend.
+type PaymentProvider interface {
+	Invoices() ([]*square.Invoice, error)
+	CreateInvoice(req *square.InvoiceCreateRequest) (*square.Invoice, error)
+	CancelInvoice(req *square.InvoiceCancelRequest) (*square.Invoice, error)
+	// InvoiceByReference returns the invoice with the given merchant invoice
+	// number created after the given time, or nil if there isn't one.
+	InvoiceByReference(ref string, after time.Time) (*square.Invoice, error)
+}
+
+// sendEmail is swapped out in tests.
+var sendEmail = email.SendEmail
+
+// parseInvoiceReference splits a merchant invoice number built by
+// models.Event.InvoiceReference into the event's prefix and the purchase
+// request ID.
+func parseInvoiceReference(ref string) (prefix string, id int, ok bool) {
+	i := strings.LastIndex(ref, " ")
+	if i <= 0 {
+		return "", 0, false
+	}
+	id, err := strconv.Atoi(ref[i+1:])
+	if err != nil {
+		return "", 0, false
+	}
+	return ref[:i], id, true
+}
+
+var (
+	_ PaymentProvider = (*square.Client)(nil)
+	_ PaymentProvider = (*square.ConnectClient)(nil)
+)
+
+// newPaymentProvider returns the Connect API client if an access token is
+// configured and the dashboard client otherwise.
+func newPaymentProvider() (PaymentProvider, error) {
+	if len(*squareToken) > 0 {
+		return square.NewConnect(square.ConnectConfig{
+			BaseURL:    *squareConnectURL,
+			Token:      *squareToken,
+			LocationID: *squareLocation,
+			Retry:      squareRetry(),
+			RateLimit:  *squareRateLimit,
+		})
+	}
+	return squareProvider{}, nil
+}
+
+// squareProvider is a PaymentProvider backed by the shared Square dashboard
+// client, which is logged into lazily.
+type squareProvider struct{}
+
+func (squareProvider) Invoices() ([]*square.Invoice, error) {
+	sq, err := squareLogin()
+	if err != nil {
+		return nil, err
+	}
+	return sq.Invoices()
+}
+
+func (squareProvider) CreateInvoice(req *square.InvoiceCreateRequest) (*square.Invoice, error) {
+	sq, err := squareLogin()
+	if err != nil {
+		return nil, err
+	}
+	return sq.CreateInvoice(req)
+}
+
+func (squareProvider) CancelInvoice(req *square.InvoiceCancelRequest) (*square.Invoice, error) {
+	sq, err := squareLogin()
+	if err != nil {
+		return nil, err
+	}
+	return sq.CancelInvoice(req)
+}
+
+func (squareProvider) InvoiceByReference(ref string, after time.Time) (*square.Invoice, error) {
+	sq, err := squareLogin()
+	if err != nil {
+		return nil, err
+	}
+	return sq.InvoiceByReference(ref, after)
+}
+
+// squareRetry is the retry policy set by the -squareAttempts flag.
+func squareRetry() square.RetryPolicy {
+	retry := square.DefaultRetryPolicy
+	retry.MaxAttempts = *squareAttempts
+	return retry
+}
+
+var (
+	client   *square.Client
+	clientMu sync.Mutex
+)
+
+// squareLogin returns the shared dashboard client, logging in on first use.
+// The client logs in again by itself if Square expires its session.
+func squareLogin() (*square.Client, error) {
+	clientMu.Lock()
+	defer clientMu.Unlock()
+
+	if client == nil {
+		var err error
+		client, err = square.NewClient(square.Config{
+			Origin:     *squareOrigin,
+			APIOrigin:  *squareAPIOrigin,
+			Email:      *squareEmail,
+			Password:   *squarePass,
+			Cookies:    *squareCookies,
+			CookieFile: *squareCookieFile,
+			Retry:      squareRetry(),
+			RateLimit:  *squareRateLimit,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
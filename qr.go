@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/skip2/go-qrcode"
+	"github.com/ubccsss/square-invoice-tickets/models"
+)
+
+const (
+	defaultQRSize = 400
+	maxQRSize     = 1024
+)
+
+// ticketQR returns the QR code of the link to a ticket, which is what the door
+// scans.
+func ticketQR(ticket *models.Ticket, token string) (*qrcode.QRCode, error) {
+	qr, err := qrcode.New(ticket.URL(token), qrcode.Medium)
+	if err != nil {
+		return nil, errors.Wrap(err, "qr code")
+	}
+	return qr, nil
+}
+
+// qrSVG draws qr as an SVG with one unit per module, leaving the size up to
+// whoever displays it.
+func qrSVG(qr *qrcode.QRCode) string {
+	bitmap := qr.Bitmap()
+	var path strings.Builder
+	for y, row := range bitmap {
+		for x := 0; x < len(row); x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < len(row) && row[x] {
+				x++
+			}
+			fmt.Fprintf(&path, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+
+		`<rect width="100%%" height="100%%" fill="#fff"/><path fill="#000" d="%s"/></svg>`,
+		len(bitmap), len(bitmap), path.String())
+}
+
+// ticketQRCode serves the QR code of a ticket as a PNG or SVG. PNGs are
+// ?size= pixels wide.
+func (s *server) ticketQRCode(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	token := vars["token"]
+	ticket, err := s.ticketByToken(token)
+	if err != nil {
+		s.ticketErr(w, err)
+		return
+	}
+	qr, err := ticketQR(ticket, token)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	// Tokens don't change what they point at, so neither does the image.
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+
+	if vars["format"] == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		fmt.Fprint(w, qrSVG(qr))
+		return
+	}
+	size := defaultQRSize
+	if raw := r.FormValue("size"); len(raw) > 0 {
+		size, err = strconv.Atoi(raw)
+		if err != nil || size < 1 || size > maxQRSize {
+			s.err(w, withCode("invalid_size", fmt.Errorf("size must be between 1 and %d", maxQRSize)), 400)
+			return
+		}
+	}
+	png, err := qr.PNG(size)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/asaskevich/govalidator"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/models"
+)
+
+// lookupExpiry is how long the links emailed by ticket lookups work.
+const lookupExpiry = time.Hour
+
+// ResendRequest picks the ticket emails for an admin to send again. Tickets
+// are each emailed to their holder, and a purchase request's tickets are sent
+// the same way as when it was paid.
+type ResendRequest struct {
+	TicketIDs         []string
+	PurchaseRequestID int
+}
+
+// resend sends ticket emails again, for when the original failed to send or
+// got lost.
+func (s *server) resend(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	var req ResendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.err(w, err, 400)
+		return
+	}
+	var groups [][]models.Ticket
+	for _, id := range req.TicketIDs {
+		var ticket models.Ticket
+		if q := s.db.Where("id = ?", id).First(&ticket); q.RecordNotFound() {
+			s.err(w, errors.Errorf("unknown ticket %q", id), 404)
+			return
+		} else if q.Error != nil {
+			s.err(w, q.Error, 500)
+			return
+		}
+		groups = append(groups, []models.Ticket{ticket})
+	}
+	if req.PurchaseRequestID != 0 {
+		var tickets []models.Ticket
+		if err := s.db.Where("purchase_request_id = ?", req.PurchaseRequestID).
+			Order("created_at").Find(&tickets).Error; err != nil {
+			s.err(w, err, 500)
+			return
+		}
+		if len(tickets) == 0 {
+			s.err(w, withCode("no_tickets", errors.Errorf("Purchase request %d doesn't have any tickets, it may not be paid yet.", req.PurchaseRequestID)), 400)
+			return
+		}
+		groups = append(groups, tickets)
+	}
+	if len(groups) == 0 {
+		s.err(w, errors.New("no tickets or purchase request to resend"), 400)
+		return
+	}
+
+	var sent []models.Ticket
+	for _, tickets := range groups {
+		event, err := s.eventByID(tickets[0].EventID)
+		if err != nil {
+			s.err(w, err, 500)
+			return
+		}
+		if err := s.emailTickets(event, tickets); err != nil {
+			s.err(w, withCode("email_failed", errors.Wrap(err, "Couldn't send the ticket emails")), 503)
+			return
+		}
+		sent = append(sent, tickets...)
+	}
+	if err := json.NewEncoder(w).Encode(sent); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
+
+// rateLimiter allows each key limit uses per window.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu   sync.Mutex
+	uses map[string][]time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{limit: limit, window: window, uses: make(map[string][]time.Time)}
+}
+
+// allow records a use of key, reporting whether it is within the limit.
+func (rl *rateLimiter) allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	t := now()
+	recent := func(uses []time.Time) []time.Time {
+		for len(uses) > 0 && t.Sub(uses[0]) >= rl.window {
+			uses = uses[1:]
+		}
+		return uses
+	}
+	// Forget keys that haven't been used in a while so the map doesn't grow
+	// forever.
+	if len(rl.uses) > 1000 {
+		for k, uses := range rl.uses {
+			if len(recent(uses)) == 0 {
+				delete(rl.uses, k)
+			}
+		}
+	}
+	uses := recent(rl.uses[key])
+	if len(uses) >= rl.limit {
+		rl.uses[key] = uses
+		return false
+	}
+	rl.uses[key] = append(uses, t)
+	return true
+}
+
+// clientIP is the address of the client making r, used to rate limit it.
+// Behind a reverse proxy every request comes from the proxy, so with
+// -trustProxy the address the proxy added to the end of X-Forwarded-For is
+// used instead. Clients pick the rest of the header, so it is ignored.
+func clientIP(r *http.Request) string {
+	if *trustProxy {
+		forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+		if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); ip != "" {
+			return ip
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// LookupRequest asks for a link to the tickets of an email address.
+type LookupRequest struct {
+	Email string
+}
+
+// LookupResponse is sent for every lookup, whether or not the address has
+// tickets, so lookups can't be used to find out who is going.
+type LookupResponse struct {
+	Message string
+}
+
+// lookupURL is the link emailed to list someone's tickets.
+func lookupURL(token string) string {
+	return "http://tickets.ubccsss.org/tickets/" + token
+}
+
+// lookupTickets emails a link listing the tickets of an address to that
+// address. Both the address and the IP address asking are rate limited,
+// though only lookups that send an email count against the address so
+// anyone can't use up someone else's.
+func (s *server) lookupTickets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var req LookupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.err(w, err, 400)
+		return
+	}
+	addr := strings.ToLower(strings.TrimSpace(req.Email))
+	if !govalidator.IsEmail(addr) {
+		s.err(w, fieldErrors{{Field: "Email", Code: "invalid", Message: req.Email + " is not a valid email address."}}, 400)
+		return
+	}
+	if !s.lookupsByIP.allow(clientIP(r)) {
+		s.err(w, errors.New("Too many lookups, please try again later."), 429)
+		return
+	}
+
+	// The tickets are looked up and emailed in the background so the
+	// response doesn't take longer, or fail, for addresses with tickets.
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		s.emailLookup(addr)
+	}()
+	resp := LookupResponse{Message: "If " + addr + " has any tickets, a link to them is on its way."}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
+
+// emailLookup emails addr a link listing its tickets, if it has any and
+// hasn't been sent too many already. Either way the buyer was told the same
+// thing, so whether an address has tickets isn't given away.
+func (s *server) emailLookup(addr string) {
+	tickets, err := s.ticketsFor(addr)
+	if err != nil {
+		log.Println("lookup tickets err", err)
+		return
+	}
+	if len(tickets) == 0 {
+		return
+	}
+	if !s.lookupsByEmail.allow(addr) {
+		log.Printf("too many lookups for %s", addr)
+		return
+	}
+	link := lookupURL(s.signer.signLookup(addr, now().Add(lookupExpiry)))
+	body := `<p>Hey ` + tickets[0].FirstName + `,</p>
+	<p>Here's <a href="` + link + `">a link to your tickets</a>. It works for the next hour.</p>
+	<p>If you didn't ask for this, you can ignore this email.</p>
+	<p>The CSSS</p>`
+	if err := sendEmail(addr, "Your Tickets", body); err != nil {
+		log.Println("send email err", err)
+	}
+}
+
+// ticketsFor returns the tickets held or bought by an email address. Tickets
+// bought by the address but since transferred by their holder belong to the
+// new holder, so they aren't included.
+func (s *server) ticketsFor(addr string) ([]models.Ticket, error) {
+	var tickets []models.Ticket
+	bought := s.db.Table("purchase_requests").Select("id").
+		Where("deleted_at IS NULL AND LOWER(TRIM(email)) = ?", addr).QueryExpr()
+	if err := s.db.Where("LOWER(TRIM(email)) = ? OR (purchase_request_id IN (?) AND transfers = 0)", addr, bought).
+		Order("event_id, created_at").Find(&tickets).Error; err != nil {
+		return nil, errors.Wrap(err, "db tickets")
+	}
+	return tickets, nil
+}
+
+// LookupTicket is a ticket listed by a lookup link.
+type LookupTicket struct {
+	TicketResponse
+	Event EventResponse
+}
+
+// lookedUpTickets lists the tickets of the address in a lookup link.
+func (s *server) lookedUpTickets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	addr, err := s.signer.verifyLookup(mux.Vars(r)["token"])
+	if err != nil {
+		s.err(w, err, 404)
+		return
+	}
+	tickets, err := s.ticketsFor(addr)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	events := make(map[int]*models.Event)
+	resp := make([]LookupTicket, 0, len(tickets))
+	for _, ticket := range tickets {
+		event, ok := events[ticket.EventID]
+		if !ok {
+			if event, err = s.eventByID(ticket.EventID); err != nil {
+				s.err(w, err, 500)
+				return
+			}
+			events[ticket.EventID] = event
+		}
+		token := s.signer.sign(&ticket)
+		lt := LookupTicket{
+			TicketResponse: TicketResponse{Ticket: models.Ticket{
+				ID:        ticket.ID,
+				FirstName: ticket.FirstName,
+				LastName:  ticket.LastName,
+				Email:     ticket.Email,
+				Token:     token,
+			}},
+			Event: EventResponse{
+				Slug:     event.Slug,
+				Name:     event.Name,
+				Date:     event.Date,
+				Venue:    event.Venue,
+				Capacity: event.Capacity,
+			},
+		}
+		s.walletLinks(&lt.TicketResponse, token)
+		resp = append(resp, lt)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
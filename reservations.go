@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/models"
+)
+
+// ticketsIssued counts the tickets issued for an event, or for one of its
+// ticket types if tt isn't nil.
+func ticketsIssued(db *gorm.DB, event *models.Event, tt *models.TicketType) (int, error) {
+	q := db.Model(&models.Ticket{}).Where("tickets.event_id = ?", event.ID)
+	if tt != nil {
+		q = q.Joins("JOIN purchase_requests ON purchase_requests.id = tickets.purchase_request_id").
+			Where("purchase_requests.ticket_type_id = ? OR "+
+				"(IFNULL(purchase_requests.ticket_type_id, 0) = 0 AND purchase_requests.type = ?)", tt.ID, tt.Name)
+	}
+	count := 0
+	if err := q.Count(&count).Error; err != nil {
+		return 0, errors.Wrap(err, "db ticket count")
+	}
+	return count, nil
+}
+
+// seatsHeld counts the seats reserved by unpaid invoices for an event, or for
+// one of its ticket types if tt isn't nil.
+func seatsHeld(db *gorm.DB, event *models.Event, tt *models.TicketType) (int, error) {
+	q := db.Model(&models.Reservation{}).Where("event_id = ? AND released_at IS NULL", event.ID)
+	if tt != nil {
+		q = q.Where("ticket_type_id = ?", tt.ID)
+	}
+	var sums []int
+	if err := q.Pluck("IFNULL(SUM(seats), 0)", &sums).Error; err != nil {
+		return 0, errors.Wrap(err, "db seats held")
+	}
+	if len(sums) == 0 {
+		return 0, nil
+	}
+	return sums[0], nil
+}
+
+// checkSeats returns an error for the buyer if there aren't enough seats left
+// for another purchase of tt. Both issued tickets and held seats count.
+func checkSeats(db *gorm.DB, event *models.Event, tt *models.TicketType) error {
+	taken := func(tt *models.TicketType) (int, error) {
+		issued, err := ticketsIssued(db, event, tt)
+		if err != nil {
+			return 0, err
+		}
+		held, err := seatsHeld(db, event, tt)
+		if err != nil {
+			return 0, err
+		}
+		return issued + held, nil
+	}
+
+	count, err := taken(nil)
+	if err != nil {
+		return err
+	}
+	if count+tt.Seats > event.Capacity {
+		left := event.Capacity - count
+		if left < 0 {
+			left = 0
+		}
+		return withCode("sold_out", fmt.Errorf("Sorry, there are %d tickets available. This event may be sold out, or you need to check back later.", left))
+	}
+	if tt.Cap > 0 {
+		count, err := taken(tt)
+		if err != nil {
+			return err
+		}
+		if count+tt.Seats > tt.Cap {
+			return withCode("sold_out", fmt.Errorf("Sorry, %s tickets are sold out.", tt.Name))
+		}
+	}
+	return nil
+}
+
+// createAndReserve prices and saves a new purchase request and holds its
+// seats in one transaction, failing if the event or ticket type doesn't have
+// room. If claim isn't nil the seats offered to that waitlist entry are used,
+// at the price already locked in by pr.
+func (s *server) createAndReserve(pr *models.PurchaseRequest, claim *models.WaitlistEntry) error {
+	event, err := s.eventByID(pr.EventID)
+	if err != nil {
+		return err
+	}
+	tt, err := s.purchaseTicketType(pr)
+	if err != nil {
+		return err
+	}
+
+	// SQLite transactions don't stop two buyers both seeing the last seat, so
+	// reservations are also serialized here.
+	s.seatsMu.Lock()
+	defer s.seatsMu.Unlock()
+
+	// The tier is picked under the lock so two buyers can't both get its last
+	// sale.
+	if claim == nil {
+		price, err := s.priceEstimate(tt, pr)
+		if err != nil {
+			return err
+		}
+		pr.Charged = price
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Error; err != nil {
+		return errors.Wrap(err, "db begin")
+	}
+	if claim != nil {
+		t := now()
+		q := tx.Model(claim).Where("claimed_at IS NULL").UpdateColumn("claimed_at", t)
+		if err := q.Error; err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "db claim")
+		}
+		if q.RowsAffected == 0 {
+			tx.Rollback()
+			return &seatsError{withCode("claim_used", errors.New("This claim link has already been used."))}
+		}
+		if err := tx.Model(&models.Reservation{}).
+			Where("waitlist_entry_id = ? AND released_at IS NULL", claim.ID).
+			UpdateColumn("released_at", t).Error; err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "db claim seats")
+		}
+	}
+	if err := checkSeats(tx, event, tt); err != nil {
+		tx.Rollback()
+		return asSeatsError(err)
+	}
+	prepareAttendees(pr)
+	if err := tx.Create(pr).Error; err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "db purchase request")
+	}
+	if err := reserve(tx, event, tt, pr); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return errors.Wrap(err, "db commit")
+	}
+	return nil
+}
+
+// reserve holds the seats of a ticket type for pr without checking there is
+// room.
+func reserve(db *gorm.DB, event *models.Event, tt *models.TicketType, pr *models.PurchaseRequest) error {
+	reservation := models.Reservation{
+		EventID:           event.ID,
+		TicketTypeID:      tt.ID,
+		PurchaseRequestID: pr.ID,
+		Seats:             tt.Seats,
+	}
+	if err := db.Create(&reservation).Error; err != nil {
+		return errors.Wrap(err, "db reservation")
+	}
+	return nil
+}
+
+// holdSeats makes sure an existing purchase request holds its seats, taking
+// them again the same way createAndReserve does if they were released. It
+// fails with a seatsError if the event no longer has room.
+func (s *server) holdSeats(pr *models.PurchaseRequest) error {
+	event, err := s.eventByID(pr.EventID)
+	if err != nil {
+		return err
+	}
+	tt, err := s.purchaseTicketType(pr)
+	if err != nil {
+		return err
+	}
+
+	s.seatsMu.Lock()
+	defer s.seatsMu.Unlock()
+
+	tx := s.db.Begin()
+	if err := tx.Error; err != nil {
+		return errors.Wrap(err, "db begin")
+	}
+	var count int
+	if err := tx.Model(&models.Reservation{}).
+		Where("purchase_request_id = ? AND released_at IS NULL", pr.ID).
+		Count(&count).Error; err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "db reservations")
+	}
+	if count > 0 {
+		tx.Rollback()
+		return nil
+	}
+	if err := checkSeats(tx, event, tt); err != nil {
+		tx.Rollback()
+		return asSeatsError(err)
+	}
+	if err := reserve(tx, event, tt, pr); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return errors.Wrap(err, "db commit")
+	}
+	return nil
+}
+
+// asSeatsError marks an error from checkSeats meant for the buyer as a
+// seatsError.
+func asSeatsError(err error) error {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return &seatsError{err}
+	}
+	return err
+}
+
+// migrateReservations holds seats for purchase requests that were waiting on
+// payment before reservations existed, so they still count against capacity.
+// Seats are held even if that puts the event over capacity, since those
+// buyers have already been invoiced.
+func (s *server) migrateReservations() error {
+	var prs []models.PurchaseRequest
+	if err := s.db.Where("paid_at IS NULL AND canceled_at IS NULL AND invoice_failed_at IS NULL").
+		Where("IFNULL(invoice_state, '') NOT IN (?)", []string{"PAID", "CANCELED", "REFUNDED"}).
+		// Requests never invoiced are only retried for a day, see
+		// releaseAbandoned.
+		Where("IFNULL(invoice_token, '') != '' OR created_at >= ?", now().Add(-24*time.Hour)).
+		Where("id NOT IN (SELECT purchase_request_id FROM reservations)").
+		Where("id NOT IN (SELECT purchase_request_id FROM tickets)").
+		Find(&prs).Error; err != nil {
+		return errors.Wrap(err, "db unpaid purchase requests")
+	}
+	if len(prs) == 0 {
+		return nil
+	}
+
+	events := make([]*models.Event, len(prs))
+	types := make([]*models.TicketType, len(prs))
+	for i := range prs {
+		var err error
+		if events[i], err = s.eventByID(prs[i].EventID); err != nil {
+			return err
+		}
+		if types[i], err = s.purchaseTicketType(&prs[i]); err != nil {
+			return err
+		}
+	}
+	tx := s.db.Begin()
+	for i := range prs {
+		if err := reserve(tx, events[i], types[i], &prs[i]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit().Error; err != nil {
+		return errors.Wrap(err, "db commit")
+	}
+	log.Printf("held seats for %d unpaid purchase requests", len(prs))
+	return nil
+}
+
+// seatsError is returned by createAndReserve when the event is full. Its
+// message is meant for the buyer.
+type seatsError struct {
+	error
+}
+
+// releaseSeats stops holding the seats of a purchase request. It is a no-op
+// if none are held.
+func releaseSeats(db *gorm.DB, purchaseRequestID int, why string) error {
+	q := db.Model(&models.Reservation{}).
+		Where("purchase_request_id = ? AND released_at IS NULL", purchaseRequestID).
+		UpdateColumn("released_at", now())
+	if err := q.Error; err != nil {
+		return errors.Wrap(err, "db release seats")
+	}
+	if q.RowsAffected > 0 {
+		log.Printf("released seats for purchase request %d: %s", purchaseRequestID, why)
+	}
+	return nil
+}
+
+// releaseAbandoned releases the seats of purchase requests that never got an
+// invoice, once resendInvoices has given up on them.
+func (s *server) releaseAbandoned() {
+	q := s.db.Model(&models.Reservation{}).
+		Where("released_at IS NULL AND purchase_request_id IN "+
+			"(SELECT id FROM purchase_requests WHERE IFNULL(invoice_token, '') = '' AND created_at < ?)",
+			now().Add(-24*time.Hour)).
+		UpdateColumn("released_at", now())
+	if err := q.Error; err != nil {
+		log.Println("release abandoned err", err)
+		return
+	}
+	if q.RowsAffected > 0 {
+		log.Printf("released %d reservations that were never invoiced", q.RowsAffected)
+	}
+}
@@ -0,0 +1,564 @@
+package square
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ConnectURL is the base URL of the production Square Connect API.
+	ConnectURL = "https://connect.squareup.com"
+	// ConnectSandboxURL is the base URL of the Square Connect sandbox.
+	ConnectSandboxURL = "https://connect.squareupsandbox.com"
+
+	connectVersion = "2023-10-18"
+)
+
+// ConnectClient talks to the documented Square Invoices, Orders and Customers
+// APIs using an OAuth or personal access token. It exposes the same invoice
+// operations as Client so the two can be used interchangeably.
+type ConnectClient struct {
+	http       *http.Client
+	baseURL    string
+	token      string
+	locationID string
+
+	retry   RetryPolicy
+	limiter *limiter
+}
+
+// ConnectConfig describes how to connect to the Connect API.
+type ConnectConfig struct {
+	// BaseURL defaults to ConnectURL.
+	BaseURL string
+	Token   string
+	// LocationID is the location to invoice from. If empty the merchant's
+	// first active location is used.
+	LocationID string
+
+	// Retry, RateLimit and Burst work as they do in Config.
+	Retry     RetryPolicy
+	RateLimit float64
+	Burst     int
+}
+
+// NewConnect returns a client for the Connect API described by cfg.
+func NewConnect(cfg ConnectConfig) (*ConnectClient, error) {
+	c := &ConnectClient{
+		http:       &http.Client{Timeout: 30 * time.Second},
+		baseURL:    strings.TrimRight(cfg.BaseURL, "/"),
+		token:      cfg.Token,
+		locationID: cfg.LocationID,
+	}
+	if len(c.baseURL) == 0 {
+		c.baseURL = ConnectURL
+	}
+	c.retry, c.limiter = limits(cfg.Retry, cfg.RateLimit, cfg.Burst)
+	if len(c.locationID) == 0 {
+		if err := c.findLocation(); err != nil {
+			return nil, errors.Wrap(err, "findLocation")
+		}
+	}
+	return c, nil
+}
+
+type connectError struct {
+	Category string `json:"category"`
+	Code     string `json:"code"`
+	Detail   string `json:"detail"`
+	Field    string `json:"field"`
+}
+
+type connectErrors struct {
+	Errors []*connectError `json:"errors"`
+}
+
+// do sends a request to the Connect API and decodes the response into out.
+// Requests marked idempotent, either because they only read or because they
+// carry an idempotency key, are retried according to the client's
+// RetryPolicy.
+func (c *ConnectClient) do(method, path string, idempotent bool, body, out interface{}) error {
+	return c.retry.withRetry(idempotent, method+" "+path, func(int) error {
+		return c.doOnce(method, path, body, out)
+	})
+}
+
+func (c *ConnectClient) doOnce(method, path string, body, out interface{}) error {
+	c.limiter.wait()
+	url := c.baseURL + path
+	log.Printf("Hitting %s %s", method, url)
+
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, url, &reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Square-Version", connectVersion)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return &TransportError{URL: url, Err: err}
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return &TransportError{URL: url, StatusCode: resp.StatusCode, Err: err}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return connectResponseError(url, resp, buf)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(buf, out); err != nil {
+		return errors.Wrapf(err, "body: %s", string(buf))
+	}
+	return nil
+}
+
+// connectResponseError classifies a failed Connect API response into one of
+// the typed errors.
+func connectResponseError(url string, resp *http.Response, buf []byte) error {
+	code := resp.StatusCode
+	e := &connectError{Detail: string(buf)}
+	var errResp connectErrors
+	if err := json.Unmarshal(buf, &errResp); err == nil && len(errResp.Errors) > 0 {
+		e = errResp.Errors[0]
+	}
+	switch {
+	case code == 401 || code == 403 || e.Category == "AUTHENTICATION_ERROR":
+		return &AuthError{StatusCode: code, ErrorTitle: e.Code, ErrorMessage: e.Detail}
+	case code == 429 || e.Category == "RATE_LIMIT_ERROR":
+		return &RateLimitError{RetryAfter: retryAfter(resp.Header), ErrorMessage: e.Detail}
+	case code >= 500 || e.Category == "API_ERROR":
+		return &TransportError{URL: url, StatusCode: code, Err: fmt.Errorf("%s: %s", e.Code, e.Detail)}
+	}
+	return &ValidationError{StatusCode: code, ErrorTitle: e.Code, ErrorMessage: e.Detail}
+}
+
+type connectLocation struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+func (c *ConnectClient) findLocation() error {
+	var resp struct {
+		Locations []*connectLocation `json:"locations"`
+	}
+	if err := c.do("GET", "/v2/locations", true, nil, &resp); err != nil {
+		return err
+	}
+	for _, loc := range resp.Locations {
+		if loc.Status == "ACTIVE" {
+			c.locationID = loc.ID
+			return nil
+		}
+	}
+	return errors.New("no active square locations")
+}
+
+type connectMoney struct {
+	Amount   int    `json:"amount"`
+	Currency string `json:"currency"`
+}
+
+func (m *connectMoney) money() *Money {
+	if m == nil {
+		return nil
+	}
+	return &Money{Amount: m.Amount, CurrencyCode: m.Currency}
+}
+
+func toConnectMoney(m *Money) *connectMoney {
+	if m == nil {
+		return nil
+	}
+	return &connectMoney{Amount: m.Amount, Currency: m.CurrencyCode}
+}
+
+type connectCustomer struct {
+	ID           string `json:"id,omitempty"`
+	GivenName    string `json:"given_name,omitempty"`
+	FamilyName   string `json:"family_name,omitempty"`
+	EmailAddress string `json:"email_address,omitempty"`
+}
+
+type connectPaymentRequest struct {
+	UID                       string        `json:"uid,omitempty"`
+	RequestType               string        `json:"request_type"`
+	DueDate                   string        `json:"due_date,omitempty"`
+	ComputedAmountMoney       *connectMoney `json:"computed_amount_money,omitempty"`
+	TotalCompletedAmountMoney *connectMoney `json:"total_completed_amount_money,omitempty"`
+}
+
+type connectRecipient struct {
+	CustomerID   string `json:"customer_id"`
+	GivenName    string `json:"given_name,omitempty"`
+	FamilyName   string `json:"family_name,omitempty"`
+	EmailAddress string `json:"email_address,omitempty"`
+}
+
+type connectInvoice struct {
+	ID                     string                   `json:"id,omitempty"`
+	Version                int                      `json:"version,omitempty"`
+	LocationID             string                   `json:"location_id"`
+	OrderID                string                   `json:"order_id"`
+	InvoiceNumber          string                   `json:"invoice_number,omitempty"`
+	Title                  string                   `json:"title,omitempty"`
+	Description            string                   `json:"description,omitempty"`
+	Status                 string                   `json:"status,omitempty"`
+	DeliveryMethod         string                   `json:"delivery_method,omitempty"`
+	PrimaryRecipient       *connectRecipient        `json:"primary_recipient"`
+	PaymentRequests        []*connectPaymentRequest `json:"payment_requests"`
+	AcceptedPaymentMethods map[string]bool          `json:"accepted_payment_methods,omitempty"`
+	PublicURL              string                   `json:"public_url,omitempty"`
+	CreatedAt              string                   `json:"created_at,omitempty"`
+	UpdatedAt              string                   `json:"updated_at,omitempty"`
+}
+
+type connectInvoiceResponse struct {
+	Invoice *connectInvoice `json:"invoice"`
+}
+
+func connectTime(s string) *Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil
+	}
+	return &Time{InstantUsec: uint64(t.UnixNano() / 1000)}
+}
+
+// deliveryStatus maps a Connect invoice onto the dashboard's delivery status.
+// Connect doesn't report whether the email arrived, only how the invoice is
+// sent, so published invoices that Square emails count as delivered.
+func (ci *connectInvoice) deliveryStatus() string {
+	switch {
+	case ci.Status == "DRAFT":
+		return ""
+	case ci.Status == "SCHEDULED":
+		return "SCHEDULED"
+	case ci.DeliveryMethod == "EMAIL":
+		return "DELIVERED"
+	}
+	return "NOT_SENT"
+}
+
+// invoice converts a Connect invoice into the dashboard Invoice type.
+func (ci *connectInvoice) invoice() *Invoice {
+	invoice := &Invoice{
+		Token:                 ci.ID,
+		LockVersion:           ci.Version,
+		MerchantInvoiceNumber: ci.InvoiceNumber,
+		InvoiceName:           ci.Title,
+		Description:           ci.Description,
+		State:                 ci.Status,
+		DeliveryStatus:        ci.deliveryStatus(),
+		UnitToken:             ci.LocationID,
+		CreatedAt:             connectTime(ci.CreatedAt),
+		UpdatedAt:             connectTime(ci.UpdatedAt),
+	}
+	if r := ci.PrimaryRecipient; r != nil {
+		invoice.PayerEmail = r.EmailAddress
+		invoice.PayerName = strings.TrimSpace(r.GivenName + " " + r.FamilyName)
+		invoice.Payer = &Payer{
+			DisplayName: invoice.PayerName,
+			Email:       r.EmailAddress,
+		}
+	}
+	if len(ci.PaymentRequests) > 0 {
+		invoice.RequestedMoney = ci.PaymentRequests[0].ComputedAmountMoney.money()
+	}
+	return invoice
+}
+
+// Invoices returns every invoice at the client's location.
+func (c *ConnectClient) Invoices() ([]*Invoice, error) {
+	var invoices []*Invoice
+	cursor := ""
+	for {
+		q := url.Values{}
+		q.Set("location_id", c.locationID)
+		q.Set("limit", "200")
+		if len(cursor) > 0 {
+			q.Set("cursor", cursor)
+		}
+		var resp struct {
+			Invoices []*connectInvoice `json:"invoices"`
+			Cursor   string            `json:"cursor"`
+		}
+		if err := c.do("GET", "/v2/invoices?"+q.Encode(), true, nil, &resp); err != nil {
+			return nil, err
+		}
+		for _, ci := range resp.Invoices {
+			invoices = append(invoices, ci.invoice())
+		}
+		if len(resp.Cursor) == 0 {
+			return invoices, nil
+		}
+		cursor = resp.Cursor
+	}
+}
+
+// EachInvoice calls fn for every invoice at the client's location created
+// after the given time, newest first. A zero time visits every invoice.
+// Paging stops at the first page with no invoices after the cutoff. If fn
+// returns an error, iteration stops and the error is returned.
+func (c *ConnectClient) EachInvoice(after time.Time, fn func(*Invoice) error) error {
+	cursor := ""
+	for {
+		search := map[string]interface{}{
+			"query": map[string]interface{}{
+				"filter": map[string]interface{}{
+					"location_ids": []string{c.locationID},
+				},
+				"sort": map[string]string{"field": "INVOICE_SORT_DATE", "order": "DESC"},
+			},
+			"limit": 200,
+		}
+		if len(cursor) > 0 {
+			search["cursor"] = cursor
+		}
+		var resp struct {
+			Invoices []*connectInvoice `json:"invoices"`
+			Cursor   string            `json:"cursor"`
+		}
+		if err := c.do("POST", "/v2/invoices/search", true, search, &resp); err != nil {
+			return err
+		}
+		matched := false
+		for _, ci := range resp.Invoices {
+			invoice := ci.invoice()
+			if !after.IsZero() && invoice.CreatedAt != nil && !invoice.CreatedAt.Time().After(after) {
+				continue
+			}
+			matched = true
+			if err := fn(invoice); err != nil {
+				return err
+			}
+		}
+		if len(resp.Cursor) == 0 || resp.Cursor == cursor || (!after.IsZero() && !matched) {
+			return nil
+		}
+		cursor = resp.Cursor
+	}
+}
+
+// InvoiceByReference returns the invoice with the given invoice number, or nil
+// if no such invoice exists. The search endpoint can't filter by invoice
+// number, so only invoices created after the given time are scanned.
+func (c *ConnectClient) InvoiceByReference(ref string, after time.Time) (*Invoice, error) {
+	var found *Invoice
+	err := c.EachInvoice(after, func(invoice *Invoice) error {
+		if invoice.MerchantInvoiceNumber == ref {
+			found = invoice
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && err != errFound {
+		return nil, err
+	}
+	return found, nil
+}
+
+func (c *ConnectClient) customer(payer *Payer) (string, error) {
+	var search struct {
+		Customers []*connectCustomer `json:"customers"`
+	}
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"filter": map[string]interface{}{
+				"email_address": map[string]string{"exact": payer.Email},
+			},
+		},
+		"limit": 1,
+	}
+	if err := c.do("POST", "/v2/customers/search", true, query, &search); err != nil {
+		return "", err
+	}
+	if len(search.Customers) > 0 {
+		return search.Customers[0].ID, nil
+	}
+
+	cust := connectCustomer{EmailAddress: payer.Email}
+	parts := strings.Split(payer.DisplayName, " ")
+	cust.FamilyName = parts[len(parts)-1]
+	cust.GivenName = strings.Join(parts[:len(parts)-1], " ")
+	var created struct {
+		Customer *connectCustomer `json:"customer"`
+	}
+	key, err := idempotencyKey("")
+	if err != nil {
+		return "", err
+	}
+	req := struct {
+		IdempotencyKey string `json:"idempotency_key"`
+		connectCustomer
+	}{key, cust}
+	if err := c.do("POST", "/v2/customers", true, req, &created); err != nil {
+		return "", err
+	}
+	return created.Customer.ID, nil
+}
+
+type connectLineItem struct {
+	Name           string        `json:"name"`
+	Quantity       string        `json:"quantity"`
+	BasePriceMoney *connectMoney `json:"base_price_money"`
+}
+
+func lineItems(req *InvoiceCreateRequest) []*connectLineItem {
+	var items []*connectLineItem
+	if req.Cart != nil && req.Cart.LineItems != nil {
+		for _, item := range req.Cart.LineItems.Itemization {
+			li := &connectLineItem{
+				Name:     item.CustomNote,
+				Quantity: item.Quantity,
+			}
+			if item.Configuration != nil {
+				li.BasePriceMoney = toConnectMoney(item.Configuration.ItemVariationPriceMoney)
+			}
+			items = append(items, li)
+		}
+	}
+	if len(items) == 0 {
+		items = append(items, &connectLineItem{
+			Name:           req.InvoiceName,
+			Quantity:       "1",
+			BasePriceMoney: toConnectMoney(req.RequestedMoney),
+		})
+	}
+	return items
+}
+
+// idempotencyKey derives a key from ref so retried requests are deduplicated
+// by Square. An empty ref gets a random key.
+func idempotencyKey(ref string) (string, error) {
+	if len(ref) > 0 {
+		return ref, nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "idempotency key")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateInvoice creates an order for the cart, creates an invoice for it and
+// publishes the invoice so that Square emails it to the payer.
+func (c *ConnectClient) CreateInvoice(req *InvoiceCreateRequest) (*Invoice, error) {
+	if req.Payer == nil {
+		return nil, errors.New("invoice has no payer")
+	}
+	customerID, err := c.customer(req.Payer)
+	if err != nil {
+		return nil, errors.Wrap(err, "customer")
+	}
+
+	ref := req.MerchantInvoiceNumber
+	keys := make(map[string]string)
+	for _, step := range []string{"order", "invoice", "publish"} {
+		keyRef := ""
+		if len(ref) > 0 {
+			keyRef = ref + " " + step
+		}
+		if keys[step], err = idempotencyKey(keyRef); err != nil {
+			return nil, err
+		}
+	}
+
+	var order struct {
+		Order struct {
+			ID string `json:"id"`
+		} `json:"order"`
+	}
+	orderReq := map[string]interface{}{
+		"idempotency_key": keys["order"],
+		"order": map[string]interface{}{
+			"location_id":  c.locationID,
+			"reference_id": ref,
+			"line_items":   lineItems(req),
+		},
+	}
+	if err := c.do("POST", "/v2/orders", true, orderReq, &order); err != nil {
+		return nil, errors.Wrap(err, "create order")
+	}
+
+	dueDate := ""
+	if req.DueOn != nil {
+		dueDate = fmt.Sprintf("%04d-%02d-%02d", req.DueOn.Year, req.DueOn.MonthOfYear, req.DueOn.DayOfMonth)
+	}
+	invoice := &connectInvoice{
+		LocationID:       c.locationID,
+		OrderID:          order.Order.ID,
+		InvoiceNumber:    ref,
+		Title:            req.InvoiceName,
+		Description:      req.Description,
+		DeliveryMethod:   "EMAIL",
+		PrimaryRecipient: &connectRecipient{CustomerID: customerID},
+		PaymentRequests: []*connectPaymentRequest{
+			{RequestType: "BALANCE", DueDate: dueDate},
+		},
+		AcceptedPaymentMethods: map[string]bool{"card": true},
+	}
+	var created connectInvoiceResponse
+	invoiceReq := map[string]interface{}{
+		"idempotency_key": keys["invoice"],
+		"invoice":         invoice,
+	}
+	if err := c.do("POST", "/v2/invoices", true, invoiceReq, &created); err != nil {
+		return nil, errors.Wrap(err, "create invoice")
+	}
+	if req.IsDraft {
+		return created.Invoice.invoice(), nil
+	}
+
+	var published connectInvoiceResponse
+	publishReq := map[string]interface{}{
+		"idempotency_key": keys["publish"],
+		"version":         created.Invoice.Version,
+	}
+	if err := c.do("POST", "/v2/invoices/"+created.Invoice.ID+"/publish", true, publishReq, &published); err != nil {
+		return nil, errors.Wrap(err, "publish invoice")
+	}
+	return published.Invoice.invoice(), nil
+}
+
+// CancelInvoice cancels the invoice with req.Token. The Connect API always
+// notifies the recipient, so SendEmailToRecipients is ignored.
+func (c *ConnectClient) CancelInvoice(req *InvoiceCancelRequest) (*Invoice, error) {
+	var current connectInvoiceResponse
+	if err := c.do("GET", "/v2/invoices/"+req.Token, true, nil, &current); err != nil {
+		return nil, err
+	}
+	var resp connectInvoiceResponse
+	cancelReq := map[string]interface{}{
+		"version": current.Invoice.Version,
+	}
+	if err := c.do("POST", "/v2/invoices/"+req.Token+"/cancel", false, cancelReq, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Invoice.invoice(), nil
+}
@@ -0,0 +1,255 @@
+package square
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fixtureServer replays recorded Connect API responses from testdata/connect.
+type fixtureServer struct {
+	*httptest.Server
+	t        *testing.T
+	routes   map[string]string
+	requests []string
+	bodies   map[string]map[string]interface{}
+}
+
+func newFixtureServer(t *testing.T, routes map[string]string) *fixtureServer {
+	f := &fixtureServer{
+		t:      t,
+		routes: routes,
+		bodies: make(map[string]map[string]interface{}),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fixtureServer) serve(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.RequestURI()
+	f.requests = append(f.requests, key)
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(401)
+		w.Write(f.fixture("unauthorized.json"))
+		return
+	}
+	if r.Method == "POST" {
+		body := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			f.t.Errorf("%s: bad body %s", key, err)
+		}
+		f.bodies[key] = body
+	}
+	name, ok := f.routes[key]
+	if !ok {
+		f.t.Errorf("unexpected request %s", key)
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(f.fixture(name))
+}
+
+func (f *fixtureServer) fixture(name string) []byte {
+	buf, err := ioutil.ReadFile(filepath.Join("testdata", "connect", name))
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return buf
+}
+
+func TestConnectInvoices(t *testing.T) {
+	f := newFixtureServer(t, map[string]string{
+		"GET /v2/locations": "locations.json",
+		"GET /v2/invoices?limit=200&location_id=L88917AVBK2S5":              "invoices_page1.json",
+		"GET /v2/invoices?cursor=page2&limit=200&location_id=L88917AVBK2S5": "invoices_page2.json",
+		"POST /v2/invoices/search":                                          "invoices_search.json",
+	})
+	defer f.Close()
+
+	c, err := NewConnect(ConnectConfig{BaseURL: f.URL, Token: "token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invoices, err := c.Invoices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invoices) != 2 {
+		t.Fatalf("len(invoices) = %d; not 2", len(invoices))
+	}
+	paid := invoices[0]
+	if paid.State != "PAID" || paid.MerchantInvoiceNumber != "PurchaseRequest2018 1" || paid.DeliveryStatus != "DELIVERED" {
+		t.Errorf("invoice = %+v", paid)
+	}
+	if paid.PayerEmail != "amelia@example.com" || paid.PayerName != "Amelia Earhart" {
+		t.Errorf("payer = %q %q", paid.PayerName, paid.PayerEmail)
+	}
+	if paid.RequestedMoney.Amount != 3500 || paid.RequestedMoney.CurrencyCode != "CAD" {
+		t.Errorf("RequestedMoney = %+v", paid.RequestedMoney)
+	}
+
+	after := time.Date(2018, 3, 2, 0, 0, 0, 0, time.UTC)
+	invoice, err := c.InvoiceByReference("PurchaseRequest2018 2", after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice == nil || invoice.Token != "inv:0-ChC366qAfskpGrBI_1bozs9mEA3" {
+		t.Errorf("InvoiceByReference = %+v", invoice)
+	}
+	search := f.bodies["POST /v2/invoices/search"]["query"].(map[string]interface{})
+	if sort := search["sort"].(map[string]interface{}); sort["order"] != "DESC" {
+		t.Errorf("search sort = %v; want newest first", sort)
+	}
+	// Invoices from before the cutoff aren't searched.
+	if invoice, err := c.InvoiceByReference("PurchaseRequest2018 1", after); err != nil || invoice != nil {
+		t.Errorf("InvoiceByReference before the cutoff = %+v, %v; want nil", invoice, err)
+	}
+	if invoice, err := c.InvoiceByReference("PurchaseRequest2018 1", time.Time{}); err != nil || invoice == nil {
+		t.Errorf("InvoiceByReference with no cutoff = %+v, %v", invoice, err)
+	}
+}
+
+func TestConnectCreateInvoice(t *testing.T) {
+	f := newFixtureServer(t, map[string]string{
+		"POST /v2/customers/search": "customers_search.json",
+		"POST /v2/customers":        "customer_create.json",
+		"POST /v2/orders":           "order_create.json",
+		"POST /v2/invoices":         "invoice_create.json",
+		"POST /v2/invoices/inv:0-ChC366qAfskpGrBI_1bozs9mEA3/publish": "invoice_publish.json",
+	})
+	defer f.Close()
+
+	c, err := NewConnect(ConnectConfig{BaseURL: f.URL, Token: "token", LocationID: "L88917AVBK2S5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	amt := &Money{Amount: 12000, CurrencyCode: "CAD"}
+	invoice, err := c.CreateInvoice(&InvoiceCreateRequest{
+		Cart: &Cart{
+			LineItems: &LineItems{
+				Itemization: []*Item{
+					{
+						CustomNote:    "CSSS Year End Gala Ticket - Group",
+						Quantity:      "1",
+						Configuration: &Configuration{ItemVariationPriceMoney: amt},
+					},
+				},
+			},
+		},
+		DueOn:                 &DueDate{Year: 2018, MonthOfYear: 3, DayOfMonth: 3},
+		InvoiceName:           "CSSS Year End Gala Tickets",
+		MerchantInvoiceNumber: "PurchaseRequest2018 2",
+		Payer: &Payer{
+			DisplayName: "Grace Hopper",
+			Email:       "grace@example.com",
+		},
+		RequestedMoney: amt,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice.State != "UNPAID" || invoice.Token != "inv:0-ChC366qAfskpGrBI_1bozs9mEA3" {
+		t.Errorf("invoice = %+v", invoice)
+	}
+
+	customer := f.bodies["POST /v2/customers"]
+	if customer["given_name"] != "Grace" || customer["family_name"] != "Hopper" {
+		t.Errorf("customer request = %+v", customer)
+	}
+	order := f.bodies["POST /v2/orders"]
+	if order["idempotency_key"] != "PurchaseRequest2018 2 order" {
+		t.Errorf("order idempotency_key = %v", order["idempotency_key"])
+	}
+	created := f.bodies["POST /v2/invoices"]["invoice"].(map[string]interface{})
+	if created["order_id"] != "OLRdmtPJpyVJDFCp3jB7TZoU7JNZY" {
+		t.Errorf("invoice order_id = %v", created["order_id"])
+	}
+	reqs := created["payment_requests"].([]interface{})
+	if due := reqs[0].(map[string]interface{})["due_date"]; due != "2018-03-03" {
+		t.Errorf("due_date = %v", due)
+	}
+}
+
+func TestConnectDeliveryStatus(t *testing.T) {
+	for _, tc := range []struct {
+		status, method, want string
+	}{
+		{"DRAFT", "EMAIL", ""},
+		{"SCHEDULED", "EMAIL", "SCHEDULED"},
+		{"UNPAID", "EMAIL", "DELIVERED"},
+		{"PAID", "SHARE_MANUALLY", "NOT_SENT"},
+	} {
+		ci := connectInvoice{Status: tc.status, DeliveryMethod: tc.method}
+		if got := ci.invoice().DeliveryStatus; got != tc.want {
+			t.Errorf("delivery status of %s %s invoice = %q; not %q", tc.status, tc.method, got, tc.want)
+		}
+	}
+}
+
+func TestConnectCancelInvoice(t *testing.T) {
+	f := newFixtureServer(t, map[string]string{
+		"GET /v2/invoices/inv:0-ChC366qAfskpGrBI_1bozs9mEA3":         "invoice_get.json",
+		"POST /v2/invoices/inv:0-ChC366qAfskpGrBI_1bozs9mEA3/cancel": "invoice_cancel.json",
+	})
+	defer f.Close()
+
+	c, err := NewConnect(ConnectConfig{BaseURL: f.URL, Token: "token", LocationID: "L88917AVBK2S5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invoice, err := c.CancelInvoice(&InvoiceCancelRequest{Token: "inv:0-ChC366qAfskpGrBI_1bozs9mEA3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice.State != "CANCELED" {
+		t.Errorf("State = %s; not CANCELED", invoice.State)
+	}
+	body := f.bodies["POST /v2/invoices/inv:0-ChC366qAfskpGrBI_1bozs9mEA3/cancel"]
+	if body["version"] != float64(1) {
+		t.Errorf("cancel version = %v; not 1", body["version"])
+	}
+}
+
+func TestConnectUnauthorized(t *testing.T) {
+	f := newFixtureServer(t, nil)
+	defer f.Close()
+
+	_, err := NewConnect(ConnectConfig{BaseURL: f.URL, Token: "bad"})
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("NewConnect with bad token = %v; want AuthError", err)
+	}
+	if authErr.ErrorTitle != "UNAUTHORIZED" {
+		t.Errorf("ErrorTitle = %q", authErr.ErrorTitle)
+	}
+}
+
+func TestConnectConfig(t *testing.T) {
+	c, err := NewConnect(ConnectConfig{
+		Token:      "token",
+		LocationID: "L88917AVBK2S5",
+		Retry:      RetryPolicy{MaxAttempts: 1},
+		RateLimit:  -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.baseURL != ConnectURL || c.retry.MaxAttempts != 1 || c.limiter.rate != -1 {
+		t.Errorf("client = %s, %+v, rate %v", c.baseURL, c.retry, c.limiter.rate)
+	}
+
+	c, err = NewConnect(ConnectConfig{Token: "token", LocationID: "L88917AVBK2S5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.retry != DefaultRetryPolicy || c.limiter.rate != DefaultRateLimit || c.limiter.burst != DefaultBurst {
+		t.Errorf("default client = %+v, rate %v burst %v", c.retry, c.limiter.rate, c.limiter.burst)
+	}
+}
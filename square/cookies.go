@@ -0,0 +1,103 @@
+package square
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// fileJar is a cookie jar that saves the cookies for a fixed set of origins
+// to a file whenever the server sets one. With an empty path it behaves like
+// a plain cookiejar.
+type fileJar struct {
+	*cookiejar.Jar
+	path    string
+	origins []*url.URL
+
+	// restored is true if cookies were loaded from path.
+	restored bool
+
+	mu sync.Mutex
+}
+
+type savedCookie struct {
+	Name  string
+	Value string
+}
+
+func newFileJar(path string, origins ...string) (*fileJar, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	j := &fileJar{Jar: jar, path: path}
+	for _, origin := range origins {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return nil, err
+		}
+		j.origins = append(j.origins, u)
+	}
+	if len(path) == 0 {
+		return j, nil
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	} else if err != nil {
+		return nil, err
+	}
+	saved := make(map[string][]savedCookie)
+	if err := json.Unmarshal(buf, &saved); err != nil {
+		log.Printf("ignoring corrupt square cookie file %s: %s", path, err)
+		return j, nil
+	}
+	for _, u := range j.origins {
+		var cookies []*http.Cookie
+		for _, c := range saved[u.String()] {
+			cookies = append(cookies, &http.Cookie{Name: c.Name, Value: c.Value, Path: "/"})
+		}
+		if len(cookies) > 0 {
+			j.Jar.SetCookies(u, cookies)
+			j.restored = true
+		}
+	}
+	return j, nil
+}
+
+func (j *fileJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.Jar.SetCookies(u, cookies)
+	if len(j.path) == 0 {
+		return
+	}
+	if err := j.save(); err != nil {
+		log.Printf("saving square cookies: %s", err)
+	}
+}
+
+func (j *fileJar) save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	saved := make(map[string][]savedCookie)
+	for _, u := range j.origins {
+		for _, c := range j.Jar.Cookies(u) {
+			saved[u.String()] = append(saved[u.String()], savedCookie{c.Name, c.Value})
+		}
+	}
+	buf, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
@@ -0,0 +1,72 @@
+package square
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AuthError is returned when Square rejects the client's credentials or
+// session and logging in again didn't help.
+type AuthError struct {
+	StatusCode   int
+	ErrorTitle   string
+	ErrorMessage string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("square auth error %d: %s %s", e.StatusCode, e.ErrorTitle, e.ErrorMessage)
+}
+
+// RateLimitError is returned when Square throttles the client. RetryAfter is
+// zero if Square didn't say how long to wait.
+type RateLimitError struct {
+	RetryAfter   time.Duration
+	ErrorMessage string
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("square rate limited (retry after %s): %s", e.RetryAfter, e.ErrorMessage)
+}
+
+// ValidationError is returned when Square refuses a request because of its
+// contents, e.g. an invalid payer email. ErrorTitle and ErrorMessage are
+// suitable for showing to the buyer.
+type ValidationError struct {
+	StatusCode   int
+	ErrorTitle   string
+	ErrorMessage string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("square validation error %d: %s: %s", e.StatusCode, e.ErrorTitle, e.ErrorMessage)
+}
+
+// TransportError is returned when Square couldn't be reached or failed to
+// handle the request. StatusCode is zero for network errors.
+type TransportError struct {
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+func (e *TransportError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("square unavailable %d %s: %s", e.StatusCode, e.URL, e.Err)
+	}
+	return fmt.Sprintf("square unavailable %s: %s", e.URL, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// retryAfter parses a Retry-After header given in seconds.
+func retryAfter(header http.Header) time.Duration {
+	secs, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || secs < 0 {
+		return 0
+	}
+	return time.Duration(secs) * time.Second
+}
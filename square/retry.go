@@ -0,0 +1,148 @@
+package square
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy controls how failed requests are retried. Only requests that
+// are safe to repeat are retried, and only after transport errors and rate
+// limiting.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of tries, including the first. One
+	// disables retries.
+	MaxAttempts int
+	// BaseDelay is doubled after every failed attempt, up to MaxDelay. The
+	// actual wait is a random duration up to that value.
+	BaseDelay, MaxDelay time.Duration
+}
+
+// DefaultRetryPolicy is used when Config.Retry is left zero.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+const (
+	// DefaultRateLimit is the default number of requests per second a client
+	// sends to Square.
+	DefaultRateLimit = 5
+	// DefaultBurst is how many requests a client may send at once before
+	// being limited.
+	DefaultBurst = 10
+)
+
+// backoff returns a jittered delay before retry number attempt+1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay << uint(attempt)
+	if d > p.MaxDelay || d <= 0 {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// retryable reports whether err is worth retrying and the minimum time to
+// wait before doing so.
+func retryable(err error) (bool, time.Duration) {
+	var rateLimit *RateLimitError
+	var transport *TransportError
+	switch {
+	case errors.As(err, &rateLimit):
+		return true, rateLimit.RetryAfter
+	case errors.As(err, &transport):
+		return true, 0
+	}
+	return false, 0
+}
+
+// withRetry calls fn until it succeeds, returns an error that isn't
+// retryable, or the policy runs out of attempts. If retry is false fn is only
+// called once. fn is passed the zero based attempt number.
+func (p RetryPolicy) withRetry(retry bool, what string, fn func(attempt int) error) error {
+	attempts := p.MaxAttempts
+	if !retry || attempts < 1 {
+		attempts = 1
+	}
+	for attempt := 0; ; attempt++ {
+		err := fn(attempt)
+		if err == nil {
+			return nil
+		}
+		ok, wait := retryable(err)
+		if !ok || attempt+1 >= attempts {
+			return err
+		}
+		if d := p.backoff(attempt); d > wait {
+			wait = d
+		}
+		log.Printf("square %s failed (%s), retrying in %s", what, err, wait)
+		time.Sleep(wait)
+	}
+}
+
+// limiter is a token bucket that spaces out requests to Square.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// limits fills in the defaults for zero retry and rate limit settings.
+func limits(retry RetryPolicy, rate float64, burst int) (RetryPolicy, *limiter) {
+	if retry.MaxAttempts == 0 {
+		retry = DefaultRetryPolicy
+	}
+	if rate == 0 {
+		rate = DefaultRateLimit
+	}
+	if burst == 0 {
+		burst = DefaultBurst
+	}
+	return retry, newLimiter(rate, burst)
+}
+
+// newLimiter returns a limiter allowing rate requests per second with bursts
+// of up to burst requests. A non-positive rate disables limiting.
+func newLimiter(rate float64, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a request may be sent.
+func (l *limiter) wait() {
+	if l == nil || l.rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	var d time.Duration
+	if l.tokens < 0 {
+		d = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(d)
+}
@@ -7,23 +7,28 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
 const (
-	originURL               = "https://squareup.com"
-	loginURL                = "https://squareup.com/login"
-	loginPostURL            = "https://api.squareup.com/mp/login"
-	navigationURL           = "https://squareup.com/dashboard/navigation"
-	subunitsURL             = "https://squareup.com/api/v1/multiunit/subunits"
-	invoiceServiceURL       = "https://squareup.com/services/squareup.invoice.service.InvoiceService/List"
-	invoiceServiceCreateURL = "https://squareup.com/services/squareup.invoice.service.InvoiceService/Create"
-	invoiceServiceCancelURL = "https://squareup.com/services/squareup.invoice.service.InvoiceService/Cancel"
+	// DefaultOrigin is the Square dashboard origin.
+	DefaultOrigin = "https://squareup.com"
+	// DefaultAPIOrigin is the origin Square's login form posts to.
+	DefaultAPIOrigin = "https://api.squareup.com"
+
+	loginPath                = "/login"
+	loginPostPath            = "/mp/login"
+	navigationPath           = "/dashboard/navigation"
+	subunitsPath             = "/api/v1/multiunit/subunits"
+	invoiceServicePath       = "/services/squareup.invoice.service.InvoiceService/List"
+	invoiceServiceCreatePath = "/services/squareup.invoice.service.InvoiceService/Create"
+	invoiceServiceCancelPath = "/services/squareup.invoice.service.InvoiceService/Cancel"
 )
 
 var setupOnce sync.Once
@@ -34,13 +39,91 @@ type Error struct {
 	ErrorMessage string `json:"error_message"`
 }
 
-func (c *Client) makeRequest(url string, body interface{}, get bool) ([]byte, int, error) {
+// reauths counts how many times a Client has had to log in again after
+// Square rejected its session. It is only read with atomic.
+var reauths int64
+
+// makeRequest sends a request to the dashboard. Requests marked idempotent are
+// retried according to the client's RetryPolicy.
+func (c *Client) makeRequest(url string, body interface{}, get, idempotent bool) ([]byte, int, error) {
+	var buf []byte
+	var code int
+	err := c.retry.withRetry(idempotent, url, func(int) error {
+		var err error
+		buf, code, err = c.makeRequestOnce(url, body, get)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return buf, code, nil
+}
+
+func (c *Client) makeRequestOnce(url string, body interface{}, get bool) ([]byte, int, error) {
+	session := atomic.LoadInt64(&c.session)
+	buf, resp, err := c.doRequest(url, body, get)
+	if err != nil {
+		return nil, 0, err
+	}
+	if reason := authFailure(resp.StatusCode, buf); len(reason) > 0 && c.canReauth(url) {
+		if err := c.reauth(reason, session); err != nil {
+			return nil, 0, errors.Wrap(err, "reauth")
+		}
+		buf, resp, err = c.doRequest(url, body, get)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := responseError(url, resp, buf); err != nil {
+		return nil, 0, err
+	}
+	return buf, resp.StatusCode, nil
+}
+
+// responseError classifies a failed dashboard response into one of the typed
+// errors. It returns nil for successful responses.
+func responseError(url string, resp *http.Response, buf []byte) error {
+	code := resp.StatusCode
+	var errResp Error
+	jsonErr := json.Unmarshal(buf, &errResp)
+	switch {
+	case len(authFailure(code, buf)) > 0:
+		return &AuthError{
+			StatusCode:   code,
+			ErrorTitle:   errResp.ErrorTitle,
+			ErrorMessage: errResp.ErrorMessage,
+		}
+	case code == 429:
+		return &RateLimitError{
+			RetryAfter:   retryAfter(resp.Header),
+			ErrorMessage: errResp.ErrorMessage,
+		}
+	case code >= 500:
+		return &TransportError{
+			URL:        url,
+			StatusCode: code,
+			Err:        fmt.Errorf("%s", buf),
+		}
+	case jsonErr != nil:
+		return errors.Wrapf(jsonErr, "body: %s", string(buf))
+	case errResp.Success != nil && *errResp.Success == false:
+		return &ValidationError{
+			StatusCode:   code,
+			ErrorTitle:   errResp.ErrorTitle,
+			ErrorMessage: errResp.ErrorMessage,
+		}
+	}
+	return nil
+}
+
+func (c *Client) doRequest(url string, body interface{}, get bool) ([]byte, *http.Response, error) {
+	c.limiter.wait()
 	log.Printf("Hitting %s", url)
 
 	var postBody bytes.Buffer
 	if !get {
 		if err := json.NewEncoder(&postBody).Encode(body); err != nil {
-			return nil, 0, err
+			return nil, nil, err
 		}
 		log.Println("req", postBody.String())
 	}
@@ -49,6 +132,9 @@ func (c *Client) makeRequest(url string, body interface{}, get bool) ([]byte, in
 		method = "GET"
 	}
 	req, err := http.NewRequest(method, url, &postBody)
+	if err != nil {
+		return nil, nil, err
+	}
 	if !get {
 		req.Header.Set("Content-Type", "application/json")
 	}
@@ -60,60 +146,151 @@ func (c *Client) makeRequest(url string, body interface{}, get bool) ([]byte, in
 	}
 	log.Printf("X-CSRF-Token: %q", csrf)
 	req.Header.Set("X-CSRF-Token", csrf)
-	if len(c.merchantToken) > 0 {
-		req.Header.Set("X-Merchant-Token", c.merchantToken)
+	if merchantToken, _ := c.tokens(); len(merchantToken) > 0 {
+		req.Header.Set("X-Merchant-Token", merchantToken)
 	}
-	req.Header.Set("Host", "squareup.com")
-	req.Header.Set("Origin", originURL)
-	req.Header.Set("Referer", loginURL)
+	req.Header.Set("Origin", c.origin)
+	req.Header.Set("Referer", c.origin+loginPath)
 	req.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/64.0.3282.167 Safari/537.36")
 	req.Header.Set("Accept", "application/json")
 
 	resp, err := c.http.Do(req)
 	if err != nil {
-		return nil, 0, err
+		return nil, nil, &TransportError{URL: url, Err: err}
 	}
 	defer resp.Body.Close()
-	buf, _ := ioutil.ReadAll(resp.Body)
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, &TransportError{URL: url, StatusCode: resp.StatusCode, Err: err}
+	}
+	return buf, resp, nil
+}
+
+// authFailure returns why a response means the session is no longer valid, or
+// "" if it doesn't.
+func authFailure(code int, body []byte) string {
+	if code == 401 || code == 403 {
+		return fmt.Sprintf("status %d", code)
+	}
 	var errResp Error
-	if err := json.Unmarshal(buf, &errResp); err != nil {
-		return nil, 0, errors.Wrapf(err, "body: %s", string(buf))
+	if err := json.Unmarshal(body, &errResp); err != nil {
+		return ""
 	}
-	if errResp.Success != nil && *errResp.Success == false {
-		return nil, 0, fmt.Errorf("error %s", buf)
+	msg := strings.ToLower(errResp.ErrorTitle + " " + errResp.ErrorMessage)
+	if strings.Contains(msg, "csrf") {
+		return "CSRF mismatch"
 	}
-	return buf, resp.StatusCode, nil
+	return ""
+}
+
+// canReauth reports whether a failed request to url can be retried after
+// logging in again. The requests reauth makes itself can't be.
+func (c *Client) canReauth(url string) bool {
+	switch url {
+	case c.apiOrigin + loginPostPath, c.origin + navigationPath, c.origin + subunitsPath:
+		return false
+	}
+	return len(c.email) > 0
+}
+
+// reauth logs in again with the client's credentials and refreshes the
+// merchant and unit tokens, unless the session a request was rejected with
+// has already been replaced by another request.
+func (c *Client) reauth(reason string, session int64) error {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+
+	if atomic.LoadInt64(&c.session) != session {
+		return nil
+	}
+	n := atomic.AddInt64(&reauths, 1)
+	log.Printf("square session rejected (%s), logging in again (%d so far)", reason, n)
+	if err := c.login(c.email, c.pass); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.session, 1)
+	return c.init()
+}
+
+// tokens returns the merchant and unit tokens found by init.
+func (c *Client) tokens() (merchant, unit string) {
+	c.tokenMu.RLock()
+	defer c.tokenMu.RUnlock()
+	return c.merchantToken, c.unitToken
 }
 
 type Client struct {
-	http                     *http.Client
+	http              *http.Client
+	origin, apiOrigin string
+
+	tokenMu                  sync.RWMutex
 	merchantToken, unitToken string
-}
 
-func NewCookies(rawCookies string) (*Client, error) {
-	jar, err := cookiejar.New(nil)
+	// email and pass are kept so the client can log in again when its
+	// session expires. session counts the logins, and is only changed with
+	// authMu held and read with atomic.
+	email, pass string
+	authMu      sync.Mutex
+	session     int64
+
+	retry   RetryPolicy
+	limiter *limiter
+}
+
+// Config describes how to connect to the Square dashboard. Either Cookies or
+// Email and Password must be set.
+type Config struct {
+	// Origin and APIOrigin default to DefaultOrigin and DefaultAPIOrigin.
+	// Tests point them at a squaretest.Server.
+	Origin, APIOrigin string
+
+	Email, Password string
+	// Cookies is a raw Cookie header copied from a logged in browser.
+	Cookies string
+	// CookieFile, if set, is where the session cookies are saved so that
+	// restarts can reuse the session instead of logging in again.
+	CookieFile string
+
+	// Retry defaults to DefaultRetryPolicy.
+	Retry RetryPolicy
+	// RateLimit is the maximum requests per second, with bursts of up to
+	// Burst requests. They default to DefaultRateLimit and DefaultBurst; a
+	// negative RateLimit disables limiting.
+	RateLimit float64
+	Burst     int
+}
+
+// NewClient logs into the dashboard described by cfg.
+func NewClient(cfg Config) (*Client, error) {
+	c := &Client{
+		origin:    cfg.Origin,
+		apiOrigin: cfg.APIOrigin,
+		email:     cfg.Email,
+		pass:      cfg.Password,
+	}
+	c.retry, c.limiter = limits(cfg.Retry, cfg.RateLimit, cfg.Burst)
+	if len(c.origin) == 0 {
+		c.origin = DefaultOrigin
+	}
+	if len(c.apiOrigin) == 0 {
+		c.apiOrigin = DefaultAPIOrigin
+	}
+	jar, err := newFileJar(cfg.CookieFile, c.origin, c.apiOrigin)
 	if err != nil {
 		return nil, err
 	}
-
-	header := http.Header{}
-	header.Add("Cookie", rawCookies)
-	request := http.Request{
-		Header: header,
+	c.http = &http.Client{
+		Jar: jar,
 	}
-	cookies := request.Cookies()
-	for _, path := range []string{"https://squareup.com", "https://api.squareup.com"} {
-		url, err := url.Parse(path)
-		if err != nil {
+
+	if len(cfg.Cookies) > 0 {
+		if err := c.setCookies(cfg.Cookies); err != nil {
+			return nil, err
+		}
+	} else if !jar.restored {
+		if err := c.login(cfg.Email, cfg.Password); err != nil {
 			return nil, err
 		}
-		jar.SetCookies(url, cookies)
-	}
-
-	c := &Client{
-		http: &http.Client{
-			Jar: jar,
-		},
 	}
 	if err := c.init(); err != nil {
 		return nil, err
@@ -121,23 +298,29 @@ func NewCookies(rawCookies string) (*Client, error) {
 	return c, nil
 }
 
+func NewCookies(rawCookies string) (*Client, error) {
+	return NewClient(Config{Cookies: rawCookies})
+}
+
 func New(user, pass string) (*Client, error) {
-	jar, err := cookiejar.New(nil)
-	if err != nil {
-		return nil, err
-	}
-	c := &Client{
-		http: &http.Client{
-			Jar: jar,
-		},
-	}
-	if err := c.login(user, pass); err != nil {
-		return nil, err
+	return NewClient(Config{Email: user, Password: pass})
+}
+
+func (c *Client) setCookies(rawCookies string) error {
+	header := http.Header{}
+	header.Add("Cookie", rawCookies)
+	request := http.Request{
+		Header: header,
 	}
-	if err := c.init(); err != nil {
-		return nil, err
+	cookies := request.Cookies()
+	for _, path := range []string{c.origin, c.apiOrigin} {
+		url, err := url.Parse(path)
+		if err != nil {
+			return err
+		}
+		c.http.Jar.SetCookies(url, cookies)
 	}
-	return c, nil
+	return nil
 }
 
 func (c *Client) init() error {
@@ -145,12 +328,16 @@ func (c *Client) init() error {
 	if err != nil {
 		return errors.Wrap(err, "GetNavigation")
 	}
+	c.tokenMu.Lock()
 	c.merchantToken = nav.Token
+	c.tokenMu.Unlock()
 
 	subunits, err := c.GetSubUnits()
 	if err != nil {
 		return errors.Wrap(err, "GetSubUnits")
 	}
+	c.tokenMu.Lock()
+	defer c.tokenMu.Unlock()
 	if len(subunits.Entities) > 0 {
 		entity := subunits.Entities[0]
 		c.unitToken = entity.Token
@@ -164,7 +351,7 @@ type NavigationResponse struct {
 }
 
 func (c *Client) GetNavigation() (*NavigationResponse, error) {
-	body, code, err := c.makeRequest(navigationURL, nil, false)
+	body, code, err := c.makeRequest(c.origin+navigationPath, nil, false, true)
 	if err != nil {
 		return nil, err
 	}
@@ -189,7 +376,7 @@ type SubUnitResponse struct {
 }
 
 func (c *Client) GetSubUnits() (*SubUnitResponse, error) {
-	body, code, err := c.makeRequest(subunitsURL, nil, true)
+	body, code, err := c.makeRequest(c.origin+subunitsPath, nil, true, true)
 	if err != nil {
 		return nil, err
 	}
@@ -209,7 +396,7 @@ type LoginRequest struct {
 }
 
 func (c *Client) getCSRF() error {
-	loginResp, err := c.http.Get(loginURL)
+	loginResp, err := c.http.Get(c.origin + loginPath)
 	if err != nil {
 		return err
 	}
@@ -223,7 +410,7 @@ func (c *Client) login(email, pass string) error {
 	}
 
 	req := LoginRequest{email, pass}
-	body, code, err := c.makeRequest(loginPostURL, &req, false)
+	body, code, err := c.makeRequest(c.apiOrigin+loginPostPath, &req, false, false)
 	if err != nil {
 		return err
 	}
@@ -236,6 +423,7 @@ func (c *Client) login(email, pass string) error {
 type InvoiceListRequest struct {
 	Count     int    `json:"count"`
 	UnitToken string `json:"unit_token"`
+	Cursor    string `json:"cursor,omitempty"`
 }
 
 type Money struct {
@@ -269,8 +457,11 @@ type Time struct {
 	TZName            []string `json:"tz_name"`
 }
 
+// Time converts t to a time.Time. InstantUsec is in microseconds since the
+// epoch, not seconds.
 func (t Time) Time() time.Time {
-	return time.Unix(int64(t.InstantUsec), 0)
+	usec := int64(t.InstantUsec)
+	return time.Unix(usec/1e6, (usec%1e6)*1e3)
 }
 
 type Invoice struct {
@@ -304,23 +495,97 @@ type InvoiceListResponse struct {
 	Invoice    []*Invoice `json:"invoice"`
 }
 
-func (c *Client) Invoices() ([]*Invoice, error) {
-	url := invoiceServiceURL
-	req := InvoiceListRequest{10000000, c.unitToken}
-	body, code, err := c.makeRequest(url, &req, false)
+// InvoicePageSize is the number of invoices requested per page.
+var InvoicePageSize = 200
+
+// InvoicesPage fetches one page of invoices starting at cursor. An empty
+// cursor fetches the first page. The returned cursor is empty on the last
+// page.
+func (c *Client) InvoicesPage(cursor string) ([]*Invoice, string, error) {
+	url := c.origin + invoiceServicePath
+	_, unitToken := c.tokens()
+	req := InvoiceListRequest{InvoicePageSize, unitToken, cursor}
+	body, code, err := c.makeRequest(url, &req, false, true)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	if code != 200 {
-		return nil, fmt.Errorf("error fetching square invoices %d, %s", code, body)
+		return nil, "", fmt.Errorf("error fetching square invoices %d, %s", code, body)
 	}
 	var resp InvoiceListResponse
 	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, "", err
+	}
+	return resp.Invoice, resp.NextCursor, nil
+}
+
+// EachInvoice calls fn for every invoice created after the given time,
+// following cursors until the last page. A zero time visits every invoice.
+// Square lists invoices newest first, so paging stops at the first page with
+// no invoices after the cutoff. If fn returns an error, iteration stops and
+// the error is returned.
+func (c *Client) EachInvoice(after time.Time, fn func(*Invoice) error) error {
+	cursor := ""
+	for {
+		invoices, next, err := c.InvoicesPage(cursor)
+		if err != nil {
+			return err
+		}
+		matched := false
+		for _, invoice := range invoices {
+			if !after.IsZero() && invoice.CreatedAt != nil && !invoice.CreatedAt.Time().After(after) {
+				continue
+			}
+			matched = true
+			if err := fn(invoice); err != nil {
+				return err
+			}
+		}
+		if len(next) == 0 || next == cursor || (!after.IsZero() && !matched) {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// Invoices returns every invoice, fetching them a page at a time.
+func (c *Client) Invoices() ([]*Invoice, error) {
+	var invoices []*Invoice
+	err := c.EachInvoice(time.Time{}, func(invoice *Invoice) error {
+		invoices = append(invoices, invoice)
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
-	return resp.Invoice, nil
+	return invoices, nil
+}
+
+// InvoiceByReference returns the invoice with the given merchant invoice
+// number, or nil if no such invoice exists. Only invoices created after the
+// given time are searched, so pass a time a little before the invoice could
+// have been created to avoid paging through the whole history.
+func (c *Client) InvoiceByReference(ref string, after time.Time) (*Invoice, error) {
+	var found *Invoice
+	err := c.EachInvoice(after, func(invoice *Invoice) error {
+		if invoice.MerchantInvoiceNumber == ref {
+			found = invoice
+			return errFound
+		}
+		return nil
+	})
+	if err != nil && err != errFound {
+		return nil, err
+	}
+	return found, nil
 }
 
+var errFound = errors.New("found")
+
+// InvoiceSearchSlack is how much earlier than an invoice's creation to start
+// searching for it, to allow for clock skew between us and Square.
+const InvoiceSearchSlack = time.Hour
+
 type Amounts struct {
 	AppliedMoney                         *Money `json:"applied_money,omitempty"`
 	DiscountMoney                        *Money `json:"discount_money,omitempty"`
@@ -394,22 +659,48 @@ type InvoiceResponse struct {
 	Invoice *Invoice `json:"invoice"`
 }
 
+// CreateInvoice creates and sends an invoice. req.MerchantInvoiceNumber acts
+// as a dedupe key: if it is set, a failed create is retried, and before each
+// retry the client checks whether the earlier attempt created the invoice
+// after all.
 func (c *Client) CreateInvoice(req *InvoiceCreateRequest) (*Invoice, error) {
-	req.UnitToken = c.unitToken
+	_, req.UnitToken = c.tokens()
+
+	ref := req.MerchantInvoiceNumber
+	start := time.Now()
+	var invoice *Invoice
+	err := c.retry.withRetry(len(ref) > 0, "create invoice "+ref, func(attempt int) error {
+		if attempt > 0 {
+			existing, err := c.InvoiceByReference(ref, start.Add(-InvoiceSearchSlack))
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				log.Printf("invoice %q was created by an earlier attempt", ref)
+				invoice = existing
+				return nil
+			}
+		}
 
-	body, code, err := c.makeRequest(invoiceServiceCreateURL, req, false)
+		body, code, err := c.makeRequest(c.origin+invoiceServiceCreatePath, req, false, false)
+		if err != nil {
+			return err
+		}
+		if code != 200 {
+			return fmt.Errorf("error creating square invoice %d, %s", code, body)
+		}
+		log.Printf("resp %s", body)
+		var resp InvoiceResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return err
+		}
+		invoice = resp.Invoice
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	if code != 200 {
-		return nil, fmt.Errorf("error creating square invoice %d, %s", code, body)
-	}
-	log.Printf("resp %s", body)
-	var resp InvoiceResponse
-	if err := json.Unmarshal(body, &resp); err != nil {
-		return nil, err
-	}
-	return resp.Invoice, nil
+	return invoice, nil
 }
 
 type InvoiceCancelRequest struct {
@@ -418,7 +709,7 @@ type InvoiceCancelRequest struct {
 }
 
 func (c *Client) CancelInvoice(req *InvoiceCancelRequest) (*Invoice, error) {
-	body, code, err := c.makeRequest(invoiceServiceCancelURL, req, false)
+	body, code, err := c.makeRequest(c.origin+invoiceServiceCancelPath, req, false, false)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,282 @@
+package square_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/square"
+	"github.com/ubccsss/square-invoice-tickets/square/squaretest"
+)
+
+func TestClient(t *testing.T) {
+	srv := squaretest.NewServer()
+	defer srv.Close()
+
+	c, err := square.NewClient(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	invoice, err := c.CreateInvoice(&square.InvoiceCreateRequest{
+		MerchantInvoiceNumber: "PurchaseRequest2018 1",
+		Payer:                 &square.Payer{DisplayName: "Ada Lovelace", Email: "ada@example.com"},
+		RequestedMoney:        &square.Money{Amount: 3500, CurrencyCode: "CAD"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invoice.State != "UNPAID" || invoice.UnitToken != squaretest.UnitToken {
+		t.Errorf("created invoice = %+v", invoice)
+	}
+
+	if err := srv.Pay(invoice.Token); err != nil {
+		t.Fatal(err)
+	}
+	found, err := c.InvoiceByReference("PurchaseRequest2018 1", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.State != "PAID" {
+		t.Errorf("InvoiceByReference = %+v", found)
+	}
+
+	canceled, err := c.CancelInvoice(&square.InvoiceCancelRequest{Token: invoice.Token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if canceled.State != "CANCELED" {
+		t.Errorf("canceled invoice state = %s", canceled.State)
+	}
+}
+
+func TestClientBadLogin(t *testing.T) {
+	srv := squaretest.NewServer()
+	defer srv.Close()
+
+	cfg := srv.Config()
+	cfg.Password = "wrong"
+	_, err := square.NewClient(cfg)
+	var authErr *square.AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("NewClient with wrong password = %v; want AuthError", err)
+	}
+	if authErr.StatusCode != 401 {
+		t.Errorf("StatusCode = %d; not 401", authErr.StatusCode)
+	}
+}
+
+func TestEachInvoice(t *testing.T) {
+	srv := squaretest.NewServer()
+	defer srv.Close()
+
+	pageSize := square.InvoicePageSize
+	square.InvoicePageSize = 2
+	defer func() { square.InvoicePageSize = pageSize }()
+
+	start := time.Now().Add(-10 * time.Hour)
+	for i := 0; i < 5; i++ {
+		created := start.Add(time.Duration(i) * time.Hour)
+		srv.AddInvoice(square.Invoice{
+			MerchantInvoiceNumber: fmt.Sprintf("ref %d", i),
+			CreatedAt:             &square.Time{InstantUsec: uint64(created.UnixNano() / 1000)},
+		})
+	}
+
+	c, err := square.NewClient(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	invoices, err := c.Invoices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invoices) != 5 {
+		t.Errorf("len(Invoices()) = %d; not 5", len(invoices))
+	}
+
+	var refs []string
+	err = c.EachInvoice(start.Add(90*time.Minute), func(invoice *square.Invoice) error {
+		refs = append(refs, invoice.MerchantInvoiceNumber)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(refs) != "[ref 4 ref 3 ref 2]" {
+		t.Errorf("EachInvoice after = %v", refs)
+	}
+
+	// Only the first page is newer than the cutoff, so the second page is the
+	// last one fetched.
+	refs = nil
+	before := srv.Requests()
+	err = c.EachInvoice(start.Add(150*time.Minute), func(invoice *square.Invoice) error {
+		refs = append(refs, invoice.MerchantInvoiceNumber)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(refs) != "[ref 4 ref 3]" {
+		t.Errorf("EachInvoice after = %v", refs)
+	}
+	if pages := srv.Requests() - before; pages != 2 {
+		t.Errorf("EachInvoice fetched %d pages; not 2", pages)
+	}
+
+	// Returning an error from fn stops paging.
+	stop := errors.New("stop")
+	refs = nil
+	err = c.EachInvoice(time.Time{}, func(invoice *square.Invoice) error {
+		refs = append(refs, invoice.MerchantInvoiceNumber)
+		if len(refs) == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || len(refs) != 3 {
+		t.Errorf("EachInvoice with an error = %v after %v", err, refs)
+	}
+}
+
+func TestTime(t *testing.T) {
+	got := square.Time{InstantUsec: 1500000000123456}.Time()
+	if want := time.Unix(1500000000, 123456000); !got.Equal(want) {
+		t.Errorf("Time() = %s; not %s", got, want)
+	}
+}
+
+func TestClientReauth(t *testing.T) {
+	srv := squaretest.NewServer()
+	defer srv.Close()
+
+	c, err := square.NewClient(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Expire()
+	if _, err := c.Invoices(); err != nil {
+		t.Fatalf("Invoices after session expiry: %s", err)
+	}
+	if n := srv.Logins(); n != 2 {
+		t.Errorf("Logins() = %d; not 2", n)
+	}
+}
+
+func TestClientReauthOnce(t *testing.T) {
+	srv := squaretest.NewServer()
+	defer srv.Close()
+
+	c, err := square.NewClient(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Expire()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Invoices(); err != nil {
+				t.Errorf("Invoices after session expiry: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := srv.Logins(); n != 2 {
+		t.Errorf("Logins() = %d; requests rejected together should log in again once", n)
+	}
+}
+
+func TestClientCookieFile(t *testing.T) {
+	srv := squaretest.NewServer()
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "square")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := srv.Config()
+	cfg.CookieFile = filepath.Join(dir, "cookies.json")
+	if _, err := square.NewClient(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := square.NewClient(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Logins(); n != 1 {
+		t.Errorf("Logins() = %d; saved session was not reused", n)
+	}
+}
+
+func TestClientValidationError(t *testing.T) {
+	srv := squaretest.NewServer()
+	defer srv.Close()
+
+	c, err := square.NewClient(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.CreateInvoice(&square.InvoiceCreateRequest{})
+	var validation *square.ValidationError
+	if !errors.As(err, &validation) {
+		t.Fatalf("CreateInvoice without payer = %v; want ValidationError", err)
+	}
+	if validation.ErrorTitle != "Payer email is required" {
+		t.Errorf("ErrorTitle = %q", validation.ErrorTitle)
+	}
+
+	srv.Close()
+	_, err = c.Invoices()
+	var transport *square.TransportError
+	if !errors.As(err, &transport) {
+		t.Fatalf("Invoices with server down = %v; want TransportError", err)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	srv := squaretest.NewServer()
+	defer srv.Close()
+
+	c, err := square.NewClient(srv.Config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := srv.Requests()
+	srv.FailNext(2)
+	if _, err := c.Invoices(); err != nil {
+		t.Fatalf("Invoices with two failures: %s", err)
+	}
+	if n := srv.Requests() - start; n != 3 {
+		t.Errorf("Invoices made %d requests; not 3", n)
+	}
+
+	srv.FailNext(1)
+	invoice, err := c.CreateInvoice(&square.InvoiceCreateRequest{
+		MerchantInvoiceNumber: "PurchaseRequest2018 1",
+		Payer:                 &square.Payer{DisplayName: "Ada Lovelace", Email: "ada@example.com"},
+	})
+	if err != nil {
+		t.Fatalf("CreateInvoice with lost response: %s", err)
+	}
+	if invoices := srv.Invoices(); len(invoices) != 1 || invoices[0].Token != invoice.Token {
+		t.Errorf("invoices after retried create = %+v", invoices)
+	}
+
+	srv.FailNext(1)
+	if _, err := c.CreateInvoice(&square.InvoiceCreateRequest{
+		Payer: &square.Payer{DisplayName: "Grace Hopper", Email: "grace@example.com"},
+	}); err == nil {
+		t.Error("CreateInvoice without a reference was retried")
+	}
+	if n := len(srv.Invoices()); n != 2 {
+		t.Errorf("len(Invoices()) = %d; not 2", n)
+	}
+}
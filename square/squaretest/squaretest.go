@@ -0,0 +1,359 @@
+// Package squaretest provides an in-memory fake of the Square dashboard
+// endpoints used by square.Client, for tests that must not hit the network.
+package squaretest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/square"
+)
+
+const (
+	// Email and Password are the credentials the fake accepts.
+	Email    = "treasurer@ubccsss.org"
+	Password = "hunter2"
+
+	MerchantToken = "MERCHANT"
+	UnitToken     = "UNIT"
+
+	csrfCookie    = "_js_csrf"
+	sessionCookie = "_session"
+	csrfToken     = "csrf-token"
+)
+
+// Server is a fake Square dashboard. It serves both the dashboard and login
+// API origins, so Config can point a square.Client at it.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	invoices []*square.Invoice
+	nextID   int
+	session  string
+	logins   int
+	fail     int
+	requests int
+}
+
+// NewServer starts a fake dashboard. Callers must call Close when done.
+func NewServer() *Server {
+	s := &Server{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", s.login)
+	mux.HandleFunc("/mp/login", s.loginPost)
+	mux.HandleFunc("/dashboard/navigation", s.authed(s.navigation))
+	mux.HandleFunc("/api/v1/multiunit/subunits", s.authed(s.subunits))
+	mux.HandleFunc("/services/squareup.invoice.service.InvoiceService/List", s.authed(s.list))
+	mux.HandleFunc("/services/squareup.invoice.service.InvoiceService/Create", s.authed(s.create))
+	mux.HandleFunc("/services/squareup.invoice.service.InvoiceService/Cancel", s.authed(s.cancel))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// Config returns a square.Config that logs into the fake. It retries quickly
+// so tests don't wait on backoff.
+func (s *Server) Config() square.Config {
+	return square.Config{
+		Origin:    s.URL,
+		APIOrigin: s.URL,
+		Email:     Email,
+		Password:  Password,
+		Retry: square.RetryPolicy{
+			MaxAttempts: 3,
+			BaseDelay:   time.Millisecond,
+			MaxDelay:    10 * time.Millisecond,
+		},
+		RateLimit: -1,
+	}
+}
+
+// Invoices returns a copy of every invoice, oldest first.
+func (s *Server) Invoices() []square.Invoice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	invoices := make([]square.Invoice, len(s.invoices))
+	for i, invoice := range s.invoices {
+		invoices[i] = *invoice
+	}
+	return invoices
+}
+
+// Expire invalidates the current session, as Square does when it logs a
+// dashboard session out early.
+func (s *Server) Expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.session = ""
+}
+
+// Logins returns the number of successful password logins.
+func (s *Server) Logins() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.logins
+}
+
+// FailNext makes the next n authenticated requests fail with a 503 after the
+// fake has handled them, as if the response was lost on the way back.
+func (s *Server) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fail = n
+}
+
+// Requests returns the number of authenticated requests received, including
+// ones that failed.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests
+}
+
+// failing counts a request and reports whether it should fail.
+func (s *Server) failing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if s.fail > 0 {
+		s.fail--
+		return true
+	}
+	return false
+}
+
+func (s *Server) validSession(r *http.Request) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.session) > 0 && hasCookie(r, sessionCookie, s.session)
+}
+
+// Pay marks the invoice with the given token as PAID.
+func (s *Server) Pay(token string) error {
+	return s.setState(token, "PAID")
+}
+
+// AddInvoice stores an invoice as if it had been created through the
+// dashboard, and returns its token.
+func (s *Server) AddInvoice(invoice square.Invoice) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.add(invoice).Token
+}
+
+// add must be called with s.mu held.
+func (s *Server) add(invoice square.Invoice) *square.Invoice {
+	s.nextID++
+	invoice.Token = fmt.Sprintf("inv-%d", s.nextID)
+	if invoice.CreatedAt == nil {
+		invoice.CreatedAt = now()
+	}
+	s.invoices = append(s.invoices, &invoice)
+	return &invoice
+}
+
+func (s *Server) setState(token, state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.setStateLocked(token, state)
+	return err
+}
+
+// setStateLocked must be called with s.mu held.
+func (s *Server) setStateLocked(token, state string) (*square.Invoice, error) {
+	for _, invoice := range s.invoices {
+		if invoice.Token == token {
+			invoice.State = state
+			invoice.UpdatedAt = now()
+			return invoice, nil
+		}
+	}
+	return nil, errors.Errorf("no invoice %s", token)
+}
+
+func now() *square.Time {
+	return &square.Time{InstantUsec: uint64(time.Now().UnixNano() / 1000)}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, title string) {
+	f := false
+	writeJSON(w, status, square.Error{
+		Success:      &f,
+		ErrorTitle:   title,
+		ErrorMessage: title,
+	})
+}
+
+func hasCookie(r *http.Request, name, value string) bool {
+	c, err := r.Cookie(name)
+	return err == nil && c.Value == value
+}
+
+func (s *Server) authed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.validSession(r) {
+			writeError(w, 401, "Unauthorized")
+			return
+		}
+		if r.Header.Get("X-CSRF-Token") != csrfToken {
+			writeError(w, 422, "Invalid CSRF token")
+			return
+		}
+		if s.failing() {
+			h(httptest.NewRecorder(), r)
+			writeError(w, 503, "Service Unavailable")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: csrfToken, Path: "/"})
+	w.Write([]byte("<html></html>"))
+}
+
+func (s *Server) loginPost(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-CSRF-Token") != csrfToken || !hasCookie(r, csrfCookie, csrfToken) {
+		writeError(w, 422, "Invalid CSRF token")
+		return
+	}
+	var req square.LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	if req.Email != Email || req.Password != Password {
+		writeError(w, 401, "Incorrect email or password")
+		return
+	}
+	s.mu.Lock()
+	s.logins++
+	s.session = fmt.Sprintf("session-%d", s.logins)
+	session := s.session
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: session, Path: "/"})
+	writeJSON(w, 200, struct{}{})
+}
+
+func (s *Server) navigation(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, square.NavigationResponse{
+		Merchant: "UBC CSSS",
+		Token:    MerchantToken,
+	})
+}
+
+func (s *Server) subunits(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, 200, square.SubUnitResponse{
+		Entities: []*square.Entity{
+			{Nickname: "CSSS", Token: UnitToken, UnitActive: true},
+		},
+	})
+}
+
+// list returns invoices newest first. Cursors are offsets into that order.
+func (s *Server) list(w http.ResponseWriter, r *http.Request) {
+	var req square.InvoiceListRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	offset := 0
+	if len(req.Cursor) > 0 {
+		var err error
+		offset, err = strconv.Atoi(req.Cursor)
+		if err != nil {
+			writeError(w, 400, "bad cursor")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var resp square.InvoiceListResponse
+	for i := len(s.invoices) - 1 - offset; i >= 0 && len(resp.Invoice) < req.Count; i-- {
+		resp.Invoice = append(resp.Invoice, s.invoices[i])
+	}
+	if end := offset + len(resp.Invoice); end < len(s.invoices) {
+		resp.NextCursor = strconv.Itoa(end)
+	}
+	writeJSON(w, 200, resp)
+}
+
+func (s *Server) create(w http.ResponseWriter, r *http.Request) {
+	var req square.InvoiceCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+	if req.Payer == nil || len(req.Payer.Email) == 0 {
+		writeError(w, 400, "Payer email is required")
+		return
+	}
+	invoice := square.Invoice{
+		DeliveryStatus:        "DELIVERED",
+		Description:           req.Description,
+		InvoiceName:           req.InvoiceName,
+		MerchantInvoiceNumber: req.MerchantInvoiceNumber,
+		MerchantToken:         MerchantToken,
+		PayerEmail:            req.Payer.Email,
+		PayerName:             req.Payer.DisplayName,
+		State:                 "UNPAID",
+		UnitToken:             req.UnitToken,
+		RequestedMoney:        req.RequestedMoney,
+		Payer:                 req.Payer,
+		DueOn:                 req.DueOn,
+		Cart:                  req.Cart,
+	}
+	if req.IsDraft {
+		invoice.State = "DRAFT"
+		invoice.DeliveryStatus = ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, 200, square.InvoiceResponse{
+		Success: true,
+		Invoice: s.add(invoice),
+	})
+}
+
+func (s *Server) cancel(w http.ResponseWriter, r *http.Request) {
+	var req square.InvoiceCancelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, 400, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invoice, err := s.setStateLocked(req.Token, "CANCELED")
+	if err != nil {
+		writeError(w, 404, err.Error())
+		return
+	}
+	writeJSON(w, 200, square.InvoiceResponse{Success: true, Invoice: invoice})
+}
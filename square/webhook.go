@@ -0,0 +1,56 @@
+package square
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+)
+
+// WebhookSignatureHeader is the header Square puts the notification signature
+// in.
+const WebhookSignatureHeader = "X-Square-Hmacsha256-Signature"
+
+// VerifyWebhook reports whether signature is the valid signature of body sent
+// to notificationURL, using the subscription's signature key.
+func VerifyWebhook(signatureKey, notificationURL string, body []byte, signature string) bool {
+	mac := hmac.New(sha256.New, []byte(signatureKey))
+	mac.Write([]byte(notificationURL))
+	mac.Write(body)
+	want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(want), []byte(signature))
+}
+
+// WebhookEvent is a webhook notification from Square. Invoice is set for
+// invoice.* events.
+type WebhookEvent struct {
+	MerchantID string `json:"merchant_id"`
+	Type       string `json:"type"`
+	EventID    string `json:"event_id"`
+	CreatedAt  string `json:"created_at"`
+
+	Invoice *Invoice `json:"-"`
+}
+
+// ParseWebhook decodes a webhook notification body.
+func ParseWebhook(body []byte) (*WebhookEvent, error) {
+	var raw struct {
+		WebhookEvent
+		Data struct {
+			Type   string `json:"type"`
+			ID     string `json:"id"`
+			Object struct {
+				Invoice *connectInvoice `json:"invoice"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	event := raw.WebhookEvent
+	if strings.HasPrefix(event.Type, "invoice.") && raw.Data.Object.Invoice != nil {
+		event.Invoice = raw.Data.Object.Invoice.invoice()
+	}
+	return &event, nil
+}
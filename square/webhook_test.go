@@ -0,0 +1,42 @@
+package square
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"testing"
+)
+
+func TestWebhook(t *testing.T) {
+	body, err := ioutil.ReadFile("testdata/connect/webhook_payment_made.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "signature-key"
+	const url = "https://tickets.ubccsss.org/api/webhooks/square"
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(url + string(body)))
+	sig := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+
+	if !VerifyWebhook(key, url, body, sig) {
+		t.Error("VerifyWebhook rejected a valid signature")
+	}
+	if VerifyWebhook(key, url+"x", body, sig) {
+		t.Error("VerifyWebhook accepted a signature for a different URL")
+	}
+	if VerifyWebhook("other", url, body, sig) {
+		t.Error("VerifyWebhook accepted a signature from a different key")
+	}
+
+	event, err := ParseWebhook(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != "invoice.payment_made" || event.Invoice == nil {
+		t.Fatalf("event = %+v", event)
+	}
+	if event.Invoice.State != "PAID" || event.Invoice.MerchantInvoiceNumber != "PurchaseRequest2018 1" {
+		t.Errorf("invoice = %+v", event.Invoice)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/asaskevich/govalidator"
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/models"
+)
+
+// defaultTicketTypes are the ticket types created for the default event from
+// the command line flags.
+func defaultTicketTypes(eventID int) []models.TicketType {
+	return []models.TicketType{
+		{EventID: eventID, Name: models.Individual, Price: *priceIndividual, Seats: 1, PromoCodes: true, RequireStudentID: true},
+		{EventID: eventID, Name: models.IndividualCS, Price: *priceIndividualCS, Seats: 1, PromoCodes: true, RequireStudentID: true},
+		{EventID: eventID, Name: models.Group, Price: *priceGroup, Seats: 4, RequireStudentID: true},
+	}
+}
+
+// migrateTicketTypes creates the default ticket types if the default event
+// has none.
+func (s *server) migrateTicketTypes() error {
+	var event models.Event
+	if q := s.db.Where("slug = ?", *eventSlug).First(&event); q.RecordNotFound() {
+		return nil
+	} else if q.Error != nil {
+		return q.Error
+	}
+	var count int
+	if err := s.db.Model(&models.TicketType{}).Where("event_id = ?", event.ID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	for _, tt := range defaultTicketTypes(event.ID) {
+		if err := s.db.Create(&tt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *server) eventTicketTypes(event *models.Event) ([]*models.TicketType, error) {
+	var types []*models.TicketType
+	if err := s.db.Where("event_id = ?", event.ID).Order("id").Find(&types).Error; err != nil {
+		return nil, errors.Wrap(err, "db ticket types")
+	}
+	return types, nil
+}
+
+// resolveTicketType looks up the ticket type named by pr.RawType and records
+// it on pr.
+func (s *server) resolveTicketType(event *models.Event, pr *models.PurchaseRequest) (*models.TicketType, error) {
+	var tt models.TicketType
+	q := s.db.Where("event_id = ? AND name = ?", event.ID, pr.RawType).First(&tt)
+	if q.RecordNotFound() {
+		return nil, withCode("unknown_ticket_type", fmt.Errorf("Unknown ticket type: %s", pr.RawType))
+	} else if q.Error != nil {
+		return nil, errors.Wrap(q.Error, "db ticket type")
+	}
+	pr.Type = tt.Name
+	pr.TicketTypeID = tt.ID
+	return &tt, nil
+}
+
+// purchaseTicketType returns the ticket type a purchase request was made
+// for. Requests from before ticket types existed are matched by name.
+func (s *server) purchaseTicketType(pr *models.PurchaseRequest) (*models.TicketType, error) {
+	var tt models.TicketType
+	q := s.db.Unscoped()
+	if pr.TicketTypeID != 0 {
+		q = q.Where("id = ?", pr.TicketTypeID)
+	} else {
+		q = q.Where("event_id = ? AND name = ?", pr.EventID, pr.Type)
+	}
+	if err := q.First(&tt).Error; err != nil {
+		return nil, errors.Wrapf(err, "ticket type for purchase request %d", pr.ID)
+	}
+	return &tt, nil
+}
+
+// TicketTypeResponse is the public view of a ticket type. Price is the
+// current tier's price if there is one.
+type TicketTypeResponse struct {
+	Name             string
+	Price            float64
+	Seats            int
+	PromoCodes       bool
+	RequireStudentID bool
+	EmailSuffix      string
+	Tier             *TierResponse
+}
+
+func (s *server) ticketTypeResponses(types []*models.TicketType) ([]TicketTypeResponse, error) {
+	resp := make([]TicketTypeResponse, 0, len(types))
+	for _, tt := range types {
+		tier, err := s.tierResponse(tt)
+		if err != nil {
+			return nil, err
+		}
+		price := tt.Price
+		if tier != nil {
+			price = tier.Price
+		}
+		resp = append(resp, TicketTypeResponse{
+			Name:             tt.Name,
+			Price:            price,
+			Seats:            tt.Seats,
+			PromoCodes:       tt.PromoCodes,
+			RequireStudentID: tt.RequireStudentID,
+			EmailSuffix:      tt.EmailSuffix,
+			Tier:             tier,
+		})
+	}
+	return resp, nil
+}
+
+func (s *server) ticketTypes(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	event, err := s.event(&r.Request)
+	if err != nil {
+		s.eventErr(w, err)
+		return
+	}
+
+	switch r.Method {
+	case "POST", "PATCH":
+		var req models.TicketType
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.err(w, err, 400)
+			return
+		}
+		req.EventID = event.ID
+		if _, err := govalidator.ValidateStruct(req); err != nil {
+			s.err(w, err, 400)
+			return
+		}
+		if req.Seats < 1 || req.Seats > models.MaxSeats {
+			s.err(w, fmt.Errorf("Seats must be between 1 and %d", models.MaxSeats), 400)
+			return
+		}
+		if r.Method == "POST" {
+			req.ID = 0
+			err = s.db.Create(&req).Error
+		} else {
+			err = s.db.Where("id = ? AND event_id = ?", req.ID, event.ID).Save(&req).Error
+		}
+		if err != nil {
+			s.err(w, err, 500)
+			return
+		}
+	case "DELETE":
+		var req models.TicketType
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			s.err(w, err, 400)
+			return
+		}
+		if req.ID == 0 {
+			s.err(w, errors.New("ID is required"), 400)
+			return
+		}
+		if err := s.db.Where("event_id = ?", event.ID).Delete(&req).Error; err != nil {
+			s.err(w, err, 500)
+			return
+		}
+	case "GET":
+	default:
+		s.err(w, fmt.Errorf("unknown method %s", r.Method), 400)
+		return
+	}
+
+	types, err := s.eventTicketTypes(event)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(types); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/models"
+)
+
+// ticketKey is a secret that signs ticket tokens. Its ID is put in every token
+// it signs so tokens from before a key was rotated can still be verified.
+type ticketKey struct {
+	ID     string
+	Secret []byte
+}
+
+// parseTicketKeys parses comma separated id:secret pairs.
+func parseTicketKeys(s string) ([]ticketKey, error) {
+	var keys []ticketKey
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, errors.Errorf("ticket key %q isn't of the form id:secret", pair)
+		}
+		if strings.Contains(parts[0], ".") {
+			return nil, errors.Errorf("ticket key ID %q can't contain a period", parts[0])
+		}
+		keys = append(keys, ticketKey{ID: parts[0], Secret: []byte(parts[1])})
+	}
+	return keys, nil
+}
+
+// ticketSigner issues and verifies the tokens that identify tickets in links
+// and QR codes. The first key signs new tokens and all of them verify.
+type ticketSigner struct {
+	keys []ticketKey
+
+	// Tickets issued before legacyBefore can also be opened by their bare ID,
+	// as links did before tokens were signed, until legacyUntil.
+	legacyBefore time.Time
+	legacyUntil  time.Time
+}
+
+// newTicketSigner returns a signer for the -ticketKeys flag. Keys are
+// required unless -debug is set, in which case one is made up and tokens stop
+// working when the server restarts.
+func newTicketSigner(flagValue string) (*ticketSigner, error) {
+	keys, err := parseTicketKeys(flagValue)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		if !*debug {
+			return nil, errors.New("-ticketKeys is required to sign ticket links")
+		}
+		log.Println("no -ticketKeys given, ticket links will only work until restart")
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, errors.Wrap(err, "random ticket key")
+		}
+		keys = append(keys, ticketKey{ID: "tmp", Secret: secret})
+	}
+	ts := &ticketSigner{keys: keys}
+	if *legacyTicketsBefore != "" || *legacyTicketLinksUntil != "" {
+		if ts.legacyBefore, err = time.Parse("2006-01-02", *legacyTicketsBefore); err != nil {
+			return nil, errors.Wrap(err, "-legacyTicketsBefore")
+		}
+		if ts.legacyUntil, err = time.Parse("2006-01-02", *legacyTicketLinksUntil); err != nil {
+			return nil, errors.Wrap(err, "-legacyTicketLinksUntil")
+		}
+	}
+	return ts, nil
+}
+
+// legacyID returns the ticket ID of an old unsigned link, if those are still
+// accepted and token could be one. Ticket IDs never contain periods.
+func (ts *ticketSigner) legacyID(token string) (string, bool) {
+	if ts.legacyUntil.IsZero() || !now().Before(ts.legacyUntil) {
+		return "", false
+	}
+	if len(token) == 0 || strings.Contains(token, ".") {
+		return "", false
+	}
+	return token, true
+}
+
+// ticketClaims are what a verified token says about its ticket.
+type ticketClaims struct {
+	TicketID string
+	EventID  int
+	IssuedAt time.Time
+}
+
+func (ts *ticketSigner) mac(key ticketKey, payload string) string {
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sign returns a token for ticket issued now, of the form
+// keyID.ticketID.eventID.issuedAt.signature.
+func (ts *ticketSigner) sign(ticket *models.Ticket) string {
+	key := ts.keys[0]
+	payload := fmt.Sprintf("%s.%s.%d.%d", key.ID, ticket.ID, ticket.EventID, now().Unix())
+	return payload + "." + ts.mac(key, payload)
+}
+
+// errBadToken is returned for tokens that are malformed or forged. It doesn't
+// say which so it can be shown to anyone.
+var errBadToken = withCode("invalid_ticket_token", errors.New("This ticket link isn't valid."))
+
+func (ts *ticketSigner) verify(token string) (*ticketClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return nil, errBadToken
+	}
+	var key *ticketKey
+	for i := range ts.keys {
+		if ts.keys[i].ID == parts[0] {
+			key = &ts.keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, errBadToken
+	}
+	payload := strings.Join(parts[:4], ".")
+	if !hmac.Equal([]byte(ts.mac(*key, payload)), []byte(parts[4])) {
+		return nil, errBadToken
+	}
+	eventID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, errBadToken
+	}
+	issued, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return nil, errBadToken
+	}
+	return &ticketClaims{
+		TicketID: parts[1],
+		EventID:  eventID,
+		IssuedAt: time.Unix(issued, 0),
+	}, nil
+}
+
+// lookupPrefix is signed along with lookup tokens so they can never be
+// mistaken for ticket tokens.
+const lookupPrefix = "lookup:"
+
+// signLookup returns a token that lists the tickets of email until expires, of
+// the form keyID.email.expires.signature with the email base64 encoded.
+func (ts *ticketSigner) signLookup(email string, expires time.Time) string {
+	key := ts.keys[0]
+	payload := fmt.Sprintf("%s.%s.%d", key.ID, base64.RawURLEncoding.EncodeToString([]byte(email)), expires.Unix())
+	return payload + "." + ts.mac(key, lookupPrefix+payload)
+}
+
+var (
+	errBadLookup     = withCode("invalid_lookup_token", errors.New("This link isn't valid."))
+	errLookupExpired = withCode("lookup_expired", errors.New("This link has expired, ask for a new one."))
+)
+
+// verifyLookup returns the email a lookup token is for.
+func (ts *ticketSigner) verifyLookup(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 4 {
+		return "", errBadLookup
+	}
+	for _, key := range ts.keys {
+		if key.ID != parts[0] {
+			continue
+		}
+		payload := strings.Join(parts[:3], ".")
+		if !hmac.Equal([]byte(ts.mac(key, lookupPrefix+payload)), []byte(parts[3])) {
+			return "", errBadLookup
+		}
+		email, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return "", errBadLookup
+		}
+		expires, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			return "", errBadLookup
+		}
+		if now().After(time.Unix(expires, 0)) {
+			return "", errLookupExpired
+		}
+		return string(email), nil
+	}
+	return "", errBadLookup
+}
+
+// ticketByToken verifies token and looks up the ticket it is for. Old
+// unsigned links are accepted while they are still allowed.
+func (s *server) ticketByToken(token string) (*models.Ticket, error) {
+	if id, ok := s.signer.legacyID(token); ok {
+		var ticket models.Ticket
+		if q := s.db.Where("id = ? AND created_at < ?", id, s.signer.legacyBefore).First(&ticket); q.RecordNotFound() {
+			return nil, errBadToken
+		} else if q.Error != nil {
+			return nil, errors.Wrap(q.Error, "db ticket")
+		}
+		return &ticket, nil
+	}
+	return s.signedTicket(token)
+}
+
+// signedTicket is like ticketByToken but only accepts signed tokens, for
+// places where a guessed ID mustn't work, such as checking in.
+func (s *server) signedTicket(token string) (*models.Ticket, error) {
+	claims, err := s.signer.verify(token)
+	if err != nil {
+		return nil, err
+	}
+	var ticket models.Ticket
+	if q := s.db.Where("id = ? AND event_id = ?", claims.TicketID, claims.EventID).First(&ticket); q.RecordNotFound() {
+		return nil, errBadToken
+	} else if q.Error != nil {
+		return nil, errors.Wrap(q.Error, "db ticket")
+	}
+	return &ticket, nil
+}
+
+// ticketErr sends an error from ticketByToken, treating bad tokens as not
+// found.
+func (s *server) ticketErr(w http.ResponseWriter, err error) {
+	status := validationStatus(err)
+	if status == 400 {
+		status = 404
+	}
+	s.err(w, err, status)
+}
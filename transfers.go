@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/asaskevich/govalidator"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/models"
+)
+
+// TransferRequest is who a holder wants to give their ticket to.
+type TransferRequest struct {
+	FirstName   string
+	LastName    string
+	Email       string
+	PhoneNumber string
+}
+
+// checkTransferable returns an error for the holder if ticket can't be passed
+// on, either because it has been used or it has been transferred as many times
+// as event allows.
+func checkTransferable(event *models.Event, ticket *models.Ticket) error {
+	if event.MaxTransfers < 0 {
+		return withCode("transfers_disabled", fmt.Errorf("Tickets for %s can't be transferred.", event.Name))
+	}
+	if ticket.CheckedInAt != nil {
+		return withCode("already_checked_in", errors.New("This ticket has already been used and can't be transferred."))
+	}
+	if event.MaxTransfers > 0 && ticket.Transfers >= event.MaxTransfers {
+		return withCode("transfer_limit", fmt.Errorf("This ticket has been transferred as many times as %s allows.", event.Name))
+	}
+	return nil
+}
+
+// requestTransfer starts transferring a ticket to someone else by emailing its
+// holder a link to confirm it, so someone who has only seen the ticket link
+// can't take it.
+func (s *server) requestTransfer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ticket, err := s.ticketByToken(mux.Vars(r)["token"])
+	if err != nil {
+		s.ticketErr(w, err)
+		return
+	}
+	event, err := s.eventByID(ticket.EventID)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	var req TransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.err(w, err, 400)
+		return
+	}
+	transfer := models.TicketTransfer{
+		EventID:       event.ID,
+		TicketID:      ticket.ID,
+		FromFirstName: ticket.FirstName,
+		FromLastName:  ticket.LastName,
+		FromEmail:     ticket.Email,
+		FirstName:     strings.TrimSpace(req.FirstName),
+		LastName:      strings.TrimSpace(req.LastName),
+		Email:         strings.TrimSpace(req.Email),
+		PhoneNumber:   strings.TrimSpace(req.PhoneNumber),
+	}
+	if _, err := govalidator.ValidateStruct(transfer); err != nil {
+		s.err(w, err, 400)
+		return
+	}
+	if err := checkTransferable(event, ticket); err != nil {
+		s.err(w, err, 400)
+		return
+	}
+	if err := s.checkNewHolder(s.db, event, transfer.Email); err != nil {
+		s.err(w, err, validationStatus(err))
+		return
+	}
+	// Each request emails the holder, so don't let it be used to spam them.
+	if !s.transfersByTicket.allow(fmt.Sprint(ticket.ID)) || !s.transfersByIP.allow(clientIP(r)) {
+		s.err(w, errors.New("Too many transfer requests, please try again later."), 429)
+		return
+	}
+
+	if transfer.ConfirmToken, err = randomToken(); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	expires := now().Add(*transferWindow)
+	transfer.ExpiresAt = &expires
+	if err := s.db.Create(&transfer).Error; err != nil {
+		s.err(w, err, 500)
+		return
+	}
+
+	body := `<p>Hey ` + ticket.FirstName + `,</p>
+	<p>Someone asked to transfer your ` + event.Name + ` ticket to ` + transfer.FirstName + ` ` + transfer.LastName +
+		` (` + transfer.Email + `).</p>
+	<p>If that was you, <a href="` + transfer.ConfirmURL() + `">confirm the transfer</a> before ` +
+		expires.Format("Jan 2 3:04 PM") + `. Your ticket will stop working and they'll be emailed a new one.</p>
+	<p>If it wasn't you, ignore this email and your ticket won't change.</p>
+	<p>The CSSS</p>`
+	if err := sendEmail(ticket.Email, event.Name+" Ticket Transfer", body); err != nil {
+		log.Println("send email err", err)
+	}
+	if err := json.NewEncoder(w).Encode(transfer); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
+
+// checkNewHolder returns an error if email already has a ticket for event, or
+// is in a purchase of one waiting on payment, since each person only gets in
+// once.
+func (s *server) checkNewHolder(db *gorm.DB, event *models.Event, email string) error {
+	normalized := strings.ToLower(strings.TrimSpace(email))
+	var count int
+	if err := db.Model(&models.Ticket{}).
+		Where("event_id = ? AND LOWER(TRIM(email)) = ?", event.ID, normalized).
+		Count(&count).Error; err != nil {
+		return errors.Wrap(err, "db ticket holders")
+	}
+	if count > 0 {
+		return fieldErrors{{
+			Field:   "Email",
+			Code:    "has_ticket",
+			Message: fmt.Sprintf("%s already has a ticket for %s.", email, event.Name),
+		}}
+	}
+	pending, err := pendingAttendees(db, event, []string{normalized}, 0)
+	if err != nil {
+		return err
+	}
+	if id, ok := pending[normalized]; ok {
+		return fieldErrors{{
+			Field:   "Email",
+			Code:    "pending_purchase",
+			Message: pendingPurchaseMessage(event, email, id),
+		}}
+	}
+	return nil
+}
+
+// confirmTransfer shows a pending transfer on GET and carries it out on POST.
+func (s *server) confirmTransfer(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	token := mux.Vars(r)["token"]
+	var transfer models.TicketTransfer
+	if token == "" || s.db.Where("confirm_token = ?", token).First(&transfer).RecordNotFound() {
+		s.err(w, errors.New("unknown transfer link"), 404)
+		return
+	}
+	if r.Method == "GET" {
+		if err := json.NewEncoder(w).Encode(transfer); err != nil {
+			s.err(w, err, 500)
+		}
+		return
+	}
+
+	if transfer.ConfirmedAt != nil {
+		s.err(w, withCode("transfer_used", errors.New("This transfer has already been confirmed.")), 400)
+		return
+	}
+	if transfer.ExpiresAt == nil || transfer.ExpiresAt.Before(now()) {
+		s.err(w, withCode("transfer_expired", errors.New("This transfer link has expired.")), 400)
+		return
+	}
+	event, err := s.eventByID(transfer.EventID)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	ticket, err := s.reissueTicket(event, &transfer)
+	if err != nil {
+		s.err(w, err, validationStatus(err))
+		return
+	}
+
+	link, files := s.ticketEmailHTML(ticket)
+	body := `<p>Hey ` + ticket.FirstName + `,</p>
+	<p>` + transfer.FromFirstName + ` ` + transfer.FromLastName + ` transferred their ticket for ` + event.Name + ` to you:</p>
+	<p>` + link + `</p>
+	<p>` + event.EmailSignoff + `</p>`
+	if err := sendEmail(ticket.Email, event.Name+" Tickets", body, files...); err != nil {
+		log.Println("send email err", err)
+	}
+	if err := json.NewEncoder(w).Encode(transfer); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
+
+// reissueTicket carries out a transfer, replacing its ticket with a new one for
+// the new holder and recording it on the transfer.
+func (s *server) reissueTicket(event *models.Event, transfer *models.TicketTransfer) (*models.Ticket, error) {
+	tx := s.db.Begin()
+	if err := tx.Error; err != nil {
+		return nil, errors.Wrap(err, "db begin")
+	}
+	var old models.Ticket
+	if q := tx.Where("id = ?", transfer.TicketID).First(&old); q.RecordNotFound() {
+		tx.Rollback()
+		return nil, withCode("ticket_transferred", errors.New("This ticket has already been transferred or canceled."))
+	} else if q.Error != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(q.Error, "db ticket")
+	}
+	if err := checkTransferable(event, &old); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := s.checkNewHolder(tx, event, transfer.Email); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	ticket := newTicket(transfer.FirstName, transfer.LastName, transfer.PhoneNumber, transfer.Email, old.PurchaseRequestID)
+	ticket.EventID = old.EventID
+	ticket.Transfers = old.Transfers + 1
+	if err := tx.Create(&ticket).Error; err != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(err, "db ticket")
+	}
+	if err := tx.Delete(&old).Error; err != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(err, "db delete ticket")
+	}
+	t := now()
+	q := tx.Model(&models.TicketTransfer{}).Where("id = ? AND confirmed_at IS NULL", transfer.ID).
+		UpdateColumns(map[string]interface{}{"new_ticket_id": ticket.ID, "confirmed_at": t})
+	if q.Error != nil {
+		tx.Rollback()
+		return nil, errors.Wrap(q.Error, "db transfer")
+	}
+	if q.RowsAffected == 0 {
+		tx.Rollback()
+		return nil, withCode("transfer_used", errors.New("This transfer has already been confirmed."))
+	}
+	if err := tx.Commit().Error; err != nil {
+		return nil, errors.Wrap(err, "db commit")
+	}
+	transfer.NewTicketID = ticket.ID
+	transfer.ConfirmedAt = &t
+	return &ticket, nil
+}
+
+// transfers lists ticket transfers, newest first, for admins.
+func (s *server) transfers(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	event, err := s.scopedEvent(&r.Request)
+	if err != nil {
+		s.eventErr(w, err)
+		return
+	}
+	query := s.db
+	if event != nil {
+		query = query.Where("event_id = ?", event.ID)
+	}
+	var records []*models.TicketTransfer
+	if err := query.Order("id DESC").Find(&records).Error; err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/abbot/go-http-auth"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/models"
+)
+
+// WaitlistResponse is returned when someone joins a waitlist.
+type WaitlistResponse struct {
+	// Position is how many people are waiting, including them, who haven't
+	// been offered seats yet.
+	Position int
+}
+
+func (s *server) joinWaitlist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	event, err := s.event(r)
+	if err != nil {
+		s.eventErr(w, err)
+		return
+	}
+	var req models.PurchaseRequest
+	if err := decodePurchaseRequest(r.Body, &req); err != nil {
+		s.err(w, err, 400)
+		return
+	}
+	req.ID = 0
+	req.InvoiceToken = ""
+	req.EventID = event.ID
+	if err := processReq(&req); err != nil {
+		s.err(w, err, 400)
+		return
+	}
+	tt, err := s.validateRequest(event, &req)
+	if err != nil {
+		s.err(w, err, validationStatus(err))
+		return
+	}
+	if err := checkSeats(s.db, event, tt); err == nil {
+		s.err(w, withCode("tickets_available", errors.New("There are still tickets available, buy one instead.")), 400)
+		return
+	}
+	if !s.joinsByIP.allow(clientIP(r)) || !s.joinsByEmail.allow(strings.ToLower(req.Email)) {
+		s.err(w, errors.New("Too many waitlist requests, please try again later."), 429)
+		return
+	}
+	// Entries whose offer expired unclaimed can join again at the back.
+	var waiting int
+	if err := s.db.Model(&models.WaitlistEntry{}).
+		Where("event_id = ? AND LOWER(email) = LOWER(?)", event.ID, req.Email).
+		Where("IFNULL(claim_token, '') = '' OR (claimed_at IS NULL AND expires_at >= ?)", now()).
+		Count(&waiting).Error; err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	if waiting > 0 {
+		s.err(w, fieldErrors{{Field: "Email", Code: "already_waitlisted", Message: req.Email + " is already on the waitlist for this event."}}, 400)
+		return
+	}
+
+	buf, err := json.Marshal(req)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	entry := models.WaitlistEntry{
+		EventID:      event.ID,
+		TicketTypeID: tt.ID,
+		FirstName:    req.FirstName,
+		LastName:     req.LastName,
+		Email:        req.Email,
+		Request:      string(buf),
+	}
+	if err := s.db.Create(&entry).Error; err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	var resp WaitlistResponse
+	if err := s.db.Model(&models.WaitlistEntry{}).
+		Where("event_id = ? AND IFNULL(claim_token, '') = '' AND id <= ?", event.ID, entry.ID).
+		Count(&resp.Position).Error; err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
+
+// waitlist lists an event's waitlist in order for admins.
+func (s *server) waitlist(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	w.Header().Set("Content-Type", "application/json")
+	event, err := s.event(&r.Request)
+	if err != nil {
+		s.eventErr(w, err)
+		return
+	}
+	var entries []*models.WaitlistEntry
+	if err := s.db.Where("event_id = ?", event.ID).Order("id").Find(&entries).Error; err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+}
+
+// ClaimResponse describes the seats offered by a claim link.
+type ClaimResponse struct {
+	Event     EventResponse
+	Type      string
+	Price     float64
+	ExpiresAt *time.Time
+	Claimed   bool
+}
+
+// claimWaitlist shows the offer behind a claim link on GET, and buys the
+// offered seats at the locked in price on POST.
+func (s *server) claimWaitlist(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	token := mux.Vars(r)["token"]
+	var entry models.WaitlistEntry
+	if token == "" || s.db.Where("claim_token = ?", token).First(&entry).RecordNotFound() {
+		s.err(w, errors.New("unknown claim link"), 404)
+		return
+	}
+	event, err := s.eventByID(entry.EventID)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	var pr models.PurchaseRequest
+	if err := json.Unmarshal([]byte(entry.Request), &pr); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	pr.ID = 0
+	pr.InvoiceToken = ""
+	pr.EventID = entry.EventID
+	pr.TicketTypeID = entry.TicketTypeID
+	tt, err := s.purchaseTicketType(&pr)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+
+	if r.Method == "GET" {
+		resp := ClaimResponse{
+			Event: EventResponse{
+				Slug:     event.Slug,
+				Name:     event.Name,
+				Date:     event.Date,
+				Venue:    event.Venue,
+				Capacity: event.Capacity,
+			},
+			Type:      tt.Name,
+			Price:     entry.Price,
+			ExpiresAt: entry.ExpiresAt,
+			Claimed:   entry.ClaimedAt != nil,
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			s.err(w, err, 500)
+		}
+		return
+	}
+
+	if entry.ClaimedAt != nil {
+		s.err(w, withCode("claim_used", errors.New("This claim link has already been used.")), 400)
+		return
+	}
+	if entry.ExpiresAt == nil || entry.ExpiresAt.Before(now()) {
+		s.err(w, withCode("claim_expired", errors.New("This claim link has expired.")), 400)
+		return
+	}
+	// Someone in the group may have gotten a ticket while they waited.
+	if err := s.validateAttendees(event, &pr); err != nil {
+		s.err(w, err, validationStatus(err))
+		return
+	}
+	pr.Type = tt.Name
+	pr.PriceTierID = entry.PriceTierID
+	pr.Charged, err = s.applyPromoCode(tt, &pr, entry.Price)
+	if err != nil {
+		s.err(w, err, validationStatus(err))
+		return
+	}
+	if err := s.createAndReserve(&pr, &entry); err != nil {
+		status, err := paymentErr(err)
+		s.err(w, err, status)
+		return
+	}
+	if err := s.createRequestAndInvoice(&pr); err != nil {
+		status, err := paymentErr(err)
+		s.err(w, err, status)
+		return
+	}
+}
+
+// expireClaims releases the seats offered to waitlist entries that weren't
+// claimed in time so they can go to the next person.
+func (s *server) expireClaims() {
+	q := s.db.Model(&models.Reservation{}).
+		Where("waitlist_entry_id != 0 AND released_at IS NULL AND expires_at < ?", now()).
+		UpdateColumn("released_at", now())
+	if err := q.Error; err != nil {
+		log.Println("expire claims err", err)
+		return
+	}
+	if q.RowsAffected > 0 {
+		log.Printf("released %d unclaimed waitlist offers", q.RowsAffected)
+	}
+}
+
+// inviteWaitlists offers freed up seats to waitlisted buyers, first come first
+// served within each event.
+func (s *server) inviteWaitlists() {
+	var eventIDs []int
+	if err := s.db.Model(&models.WaitlistEntry{}).
+		Where("IFNULL(claim_token, '') = ''").
+		Pluck("DISTINCT event_id", &eventIDs).Error; err != nil {
+		log.Println("invite waitlists err", err)
+		return
+	}
+	for _, id := range eventIDs {
+		event, err := s.eventByID(id)
+		if err != nil {
+			log.Println("invite waitlists err", err)
+			continue
+		}
+		for {
+			invited, err := s.inviteNext(event)
+			if err != nil {
+				log.Printf("invite waitlist %s err %s", event.Slug, err)
+			}
+			if !invited || err != nil {
+				break
+			}
+		}
+	}
+}
+
+// inviteNext holds seats for the first uninvited waitlist entry of event and
+// emails them a claim link, reporting whether there was room to.
+func (s *server) inviteNext(event *models.Event) (bool, error) {
+	var entry models.WaitlistEntry
+	if q := s.db.Where("event_id = ? AND IFNULL(claim_token, '') = ''", event.ID).
+		Order("id").First(&entry); q.RecordNotFound() {
+		return false, nil
+	} else if q.Error != nil {
+		return false, errors.Wrap(q.Error, "db waitlist")
+	}
+	tt, err := s.purchaseTicketType(&models.PurchaseRequest{TicketTypeID: entry.TicketTypeID})
+	if err != nil {
+		return false, err
+	}
+	token, err := randomToken()
+	if err != nil {
+		return false, err
+	}
+
+	s.seatsMu.Lock()
+	defer s.seatsMu.Unlock()
+
+	var locked models.PurchaseRequest
+	price, err := s.priceEstimate(tt, &locked)
+	if err != nil {
+		return false, err
+	}
+
+	tx := s.db.Begin()
+	if err := tx.Error; err != nil {
+		return false, errors.Wrap(err, "db begin")
+	}
+	// Later entries may want smaller ticket types that would fit, but they
+	// still wait their turn.
+	if err := checkSeats(tx, event, tt); err != nil {
+		tx.Rollback()
+		return false, nil
+	}
+	t := now()
+	expires := t.Add(*claimWindow)
+	if err := tx.Model(&entry).UpdateColumns(map[string]interface{}{
+		"claim_token":   token,
+		"price":         price,
+		"price_tier_id": locked.PriceTierID,
+		"invited_at":    t,
+		"expires_at":    expires,
+	}).Error; err != nil {
+		tx.Rollback()
+		return false, errors.Wrap(err, "db waitlist invite")
+	}
+	reservation := models.Reservation{
+		EventID:         event.ID,
+		TicketTypeID:    tt.ID,
+		WaitlistEntryID: entry.ID,
+		Seats:           tt.Seats,
+		ExpiresAt:       &expires,
+	}
+	if err := tx.Create(&reservation).Error; err != nil {
+		tx.Rollback()
+		return false, errors.Wrap(err, "db reservation")
+	}
+	if err := tx.Commit().Error; err != nil {
+		return false, errors.Wrap(err, "db commit")
+	}
+
+	entry.ClaimToken = token
+	body := `<p>Hey ` + entry.FirstName + `,</p>
+	<p>A ` + tt.Name + ` ticket for ` + event.Name + ` has opened up and we're holding it for you.</p>
+	<p><a href="` + entry.ClaimURL() + `">Claim it</a> for $` + fmt.Sprintf("%.2f", price) +
+		` before ` + expires.Format("Jan 2 3:04 PM") + `, after which it goes to the next person on the waitlist.</p>
+	<p>The CSSS</p>`
+	if err := sendEmail(entry.Email, event.Name+" Waitlist", body); err != nil {
+		// They can't claim seats they don't know about, so give them to
+		// the next person instead of holding them until the claim expires.
+		log.Printf("waitlist invite %d email err %s", entry.ID, err)
+		if err := s.db.Model(&entry).UpdateColumns(map[string]interface{}{
+			"expires_at":   t,
+			"invite_error": err.Error(),
+		}).Error; err != nil {
+			return false, errors.Wrap(err, "db waitlist invite error")
+		}
+		if err := s.db.Model(&models.Reservation{}).
+			Where("waitlist_entry_id = ? AND released_at IS NULL", entry.ID).
+			UpdateColumn("released_at", t).Error; err != nil {
+			return false, errors.Wrap(err, "db release invite")
+		}
+	}
+	return true, nil
+}
+
+// randomToken returns a hex string that is impractical to guess.
+func randomToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.Wrap(err, "random token")
+	}
+	return hex.EncodeToString(buf), nil
+}
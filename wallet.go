@@ -0,0 +1,530 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/models"
+	"go.mozilla.org/pkcs7"
+)
+
+// passOrganization is shown on passes and in Google Wallet as who issued the
+// ticket.
+const passOrganization = "UBC CSSS"
+
+// TicketResponse is a ticket as shown to its holder, with links to add it to
+// whichever wallets are set up.
+type TicketResponse struct {
+	models.Ticket
+	AppleWalletURL  string `json:",omitempty"`
+	GoogleWalletURL string `json:",omitempty"`
+}
+
+// readPEM returns the first PEM block of the file at path.
+func readPEM(path string) (*pem.Block, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", path)
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.Errorf("%s isn't PEM encoded", path)
+	}
+	return block, nil
+}
+
+func readCertificate(path string) (*x509.Certificate, error) {
+	block, err := readPEM(path)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse certificate %s", path)
+	}
+	return cert, nil
+}
+
+// parsePrivateKey parses a PEM encoded PKCS #1, PKCS #8 or EC private key.
+func parsePrivateKey(buf []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("private key isn't PEM encoded")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse private key")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// passSigner builds signed Apple Wallet passes.
+type passSigner struct {
+	passTypeID string
+	teamID     string
+	cert       *x509.Certificate
+	key        crypto.Signer
+	// wwdr is Apple's intermediate certificate, which signed cert.
+	wwdr *x509.Certificate
+	// imageDir holds the pass images, e.g. icon.png and logo.png.
+	imageDir string
+}
+
+// newPassSigner loads the pass certificates from the -pass* flags. It returns
+// nil if passes aren't set up.
+func newPassSigner() (*passSigner, error) {
+	if len(*passTypeID) == 0 {
+		return nil, nil
+	}
+	if len(*passTeamID) == 0 || len(*passCert) == 0 || len(*passKey) == 0 || len(*passWWDR) == 0 {
+		return nil, errors.New("-passTypeID needs -passTeamID, -passCert, -passKey and -passWWDR")
+	}
+	cert, err := readCertificate(*passCert)
+	if err != nil {
+		return nil, err
+	}
+	wwdr, err := readCertificate(*passWWDR)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(*passKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", *passKey)
+	}
+	key, err := parsePrivateKey(buf)
+	if err != nil {
+		return nil, errors.Wrap(err, *passKey)
+	}
+	return &passSigner{
+		passTypeID: *passTypeID,
+		teamID:     *passTeamID,
+		cert:       cert,
+		key:        key,
+		wwdr:       wwdr,
+		imageDir:   *passImages,
+	}, nil
+}
+
+type passField struct {
+	Key   string `json:"key"`
+	Label string `json:"label,omitempty"`
+	Value string `json:"value"`
+}
+
+type passBarcode struct {
+	Format          string `json:"format"`
+	Message         string `json:"message"`
+	MessageEncoding string `json:"messageEncoding"`
+	AltText         string `json:"altText,omitempty"`
+}
+
+type passStructure struct {
+	HeaderFields    []passField `json:"headerFields,omitempty"`
+	PrimaryFields   []passField `json:"primaryFields,omitempty"`
+	SecondaryFields []passField `json:"secondaryFields,omitempty"`
+	AuxiliaryFields []passField `json:"auxiliaryFields,omitempty"`
+	BackFields      []passField `json:"backFields,omitempty"`
+}
+
+// passJSON is the pass.json of an event ticket pass.
+type passJSON struct {
+	FormatVersion      int           `json:"formatVersion"`
+	PassTypeIdentifier string        `json:"passTypeIdentifier"`
+	SerialNumber       string        `json:"serialNumber"`
+	TeamIdentifier     string        `json:"teamIdentifier"`
+	OrganizationName   string        `json:"organizationName"`
+	Description        string        `json:"description"`
+	RelevantDate       string        `json:"relevantDate,omitempty"`
+	BackgroundColor    string        `json:"backgroundColor"`
+	ForegroundColor    string        `json:"foregroundColor"`
+	LabelColor         string        `json:"labelColor"`
+	Barcodes           []passBarcode `json:"barcodes"`
+	// Barcode is for iOS 8 and older, which don't know about Barcodes.
+	Barcode     passBarcode   `json:"barcode"`
+	EventTicket passStructure `json:"eventTicket"`
+}
+
+// defaultPassIcon is used when the image directory has no icon.png, since
+// passes without an icon don't install.
+func defaultPassIcon() ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, 58, 58))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{0x00, 0x2e, 0x5d, 0xff}}, image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, errors.Wrap(err, "icon png")
+	}
+	return buf.Bytes(), nil
+}
+
+// images returns the PNGs in the image directory by name.
+func (ps *passSigner) images() (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	paths, err := filepath.Glob(filepath.Join(ps.imageDir, "*.png"))
+	if err != nil {
+		return nil, errors.Wrap(err, "pass images")
+	}
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %s", path)
+		}
+		files[filepath.Base(path)] = buf
+	}
+	if _, ok := files["icon.png"]; !ok {
+		icon, err := defaultPassIcon()
+		if err != nil {
+			return nil, err
+		}
+		files["icon.png"] = icon
+	}
+	return files, nil
+}
+
+// sign returns the detached PKCS #7 signature of a manifest, signed by the
+// pass certificate and including the WWDR certificate as Wallet requires.
+func (ps *passSigner) sign(manifest []byte) ([]byte, error) {
+	sd, err := pkcs7.NewSignedData(manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "pkcs7")
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSignerChain(ps.cert, ps.key, []*x509.Certificate{ps.wwdr}, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, errors.Wrap(err, "pkcs7 signer")
+	}
+	sd.Detach()
+	signature, err := sd.Finish()
+	if err != nil {
+		return nil, errors.Wrap(err, "pkcs7 sign")
+	}
+	return signature, nil
+}
+
+// bundle zips up a pass: pass.json, the images, a manifest of their SHA-1
+// hashes and the signature of the manifest.
+func (ps *passSigner) bundle(pass *passJSON) ([]byte, error) {
+	files, err := ps.images()
+	if err != nil {
+		return nil, err
+	}
+	files["pass.json"], err = json.Marshal(pass)
+	if err != nil {
+		return nil, errors.Wrap(err, "pass.json")
+	}
+	manifest := make(map[string]string)
+	for name, buf := range files {
+		sum := sha1.Sum(buf)
+		manifest[name] = hex.EncodeToString(sum[:])
+	}
+	files["manifest.json"], err = json.Marshal(manifest)
+	if err != nil {
+		return nil, errors.Wrap(err, "manifest.json")
+	}
+	files["signature"], err = ps.sign(files["manifest.json"])
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		f, err := zw.Create(name)
+		if err != nil {
+			return nil, errors.Wrap(err, "zip")
+		}
+		if _, err := f.Write(files[name]); err != nil {
+			return nil, errors.Wrap(err, "zip")
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "zip")
+	}
+	return buf.Bytes(), nil
+}
+
+// ticketPass returns the pass.json for a ticket. Its barcode is the same link
+// as the QR code so the door can scan either.
+func (s *server) ticketPass(ticket *models.Ticket, token string) (*passJSON, error) {
+	event, err := s.eventByID(ticket.EventID)
+	if err != nil {
+		return nil, err
+	}
+	typeName, err := s.ticketTypeName(ticket)
+	if err != nil {
+		return nil, err
+	}
+	barcode := passBarcode{
+		Format:          "PKBarcodeFormatQR",
+		Message:         ticket.URL(token),
+		MessageEncoding: "iso-8859-1",
+		AltText:         ticket.ID,
+	}
+	pass := &passJSON{
+		FormatVersion:      1,
+		PassTypeIdentifier: s.passes.passTypeID,
+		SerialNumber:       ticket.ID,
+		TeamIdentifier:     s.passes.teamID,
+		OrganizationName:   passOrganization,
+		Description:        event.Name + " Ticket",
+		BackgroundColor:    "rgb(0, 46, 93)",
+		ForegroundColor:    "rgb(255, 255, 255)",
+		LabelColor:         "rgb(190, 210, 235)",
+		Barcodes:           []passBarcode{barcode},
+		Barcode:            barcode,
+	}
+	pass.EventTicket.PrimaryFields = []passField{{Key: "event", Label: "EVENT", Value: event.Name}}
+	pass.EventTicket.SecondaryFields = []passField{{Key: "name", Label: "NAME", Value: ticket.FirstName + " " + ticket.LastName}}
+	if len(typeName) > 0 {
+		pass.EventTicket.HeaderFields = []passField{{Key: "type", Label: "TICKET", Value: typeName}}
+	}
+	if !event.Date.IsZero() {
+		pass.RelevantDate = event.Date.Format(time.RFC3339)
+		pass.EventTicket.AuxiliaryFields = append(pass.EventTicket.AuxiliaryFields,
+			passField{Key: "date", Label: "DATE", Value: event.Date.Format("Jan 2, 2006 3:04 PM")})
+	}
+	if len(event.Venue) > 0 {
+		pass.EventTicket.AuxiliaryFields = append(pass.EventTicket.AuxiliaryFields,
+			passField{Key: "venue", Label: "VENUE", Value: event.Venue})
+	}
+	pass.EventTicket.BackFields = []passField{
+		{Key: "ticket", Label: "Ticket", Value: ticket.ID},
+		{Key: "link", Label: "Link", Value: ticket.URL(token)},
+	}
+	return pass, nil
+}
+
+func (s *server) ticketPKPass(w http.ResponseWriter, r *http.Request) {
+	if s.passes == nil {
+		s.err(w, errors.New("Apple Wallet passes are not configured"), 404)
+		return
+	}
+	token := mux.Vars(r)["token"]
+	ticket, err := s.ticketByToken(token)
+	if err != nil {
+		s.ticketErr(w, err)
+		return
+	}
+	pass, err := s.ticketPass(ticket, token)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	bundle, err := s.passes.bundle(pass)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/vnd.apple.pkpass")
+	w.Header().Set("Content-Disposition", `attachment; filename="ticket-`+ticket.ID+`.pkpass"`)
+	w.Write(bundle)
+}
+
+// googleWallet makes "Save to Google Wallet" links, which are JWTs signed by a
+// Google Cloud service account.
+type googleWallet struct {
+	issuerID    string
+	clientEmail string
+	key         *rsa.PrivateKey
+}
+
+// serviceAccountKey is the JSON key file of a Google Cloud service account.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+}
+
+// newGoogleWallet loads the service account key from the -googleWallet* flags.
+// It returns nil if Google Wallet isn't set up.
+func newGoogleWallet() (*googleWallet, error) {
+	if len(*googleWalletIssuer) == 0 {
+		return nil, nil
+	}
+	if len(*googleWalletKey) == 0 {
+		return nil, errors.New("-googleWalletIssuer needs -googleWalletKey")
+	}
+	buf, err := ioutil.ReadFile(*googleWalletKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", *googleWalletKey)
+	}
+	var account serviceAccountKey
+	if err := json.Unmarshal(buf, &account); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", *googleWalletKey)
+	}
+	key, err := parsePrivateKey([]byte(account.PrivateKey))
+	if err != nil {
+		return nil, errors.Wrap(err, *googleWalletKey)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("%s: service account keys must be RSA", *googleWalletKey)
+	}
+	return &googleWallet{
+		issuerID:    *googleWalletIssuer,
+		clientEmail: account.ClientEmail,
+		key:         rsaKey,
+	}, nil
+}
+
+// googleWalletID makes a class or object ID from parts, which may only have
+// letters, digits, '.', '_' and '-'.
+func googleWalletID(issuerID string, parts ...string) string {
+	id := strings.Join(parts, "-")
+	id = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, id)
+	return issuerID + "." + id
+}
+
+// signJWT returns claims as a JWT signed with RS256.
+func (gw *googleWallet) signJWT(claims interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", errors.Wrap(err, "jwt claims")
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(nil, gw.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", errors.Wrap(err, "jwt sign")
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// googleWalletURL returns the link that saves a ticket to Google Wallet. The
+// JWT carries both the event's class and the ticket's object, so nothing needs
+// to be created with the Wallet API beforehand.
+func (s *server) googleWalletURL(ticket *models.Ticket, token string) (string, error) {
+	event, err := s.eventByID(ticket.EventID)
+	if err != nil {
+		return "", err
+	}
+	typeName, err := s.ticketTypeName(ticket)
+	if err != nil {
+		return "", err
+	}
+	localized := func(value string) map[string]interface{} {
+		return map[string]interface{}{
+			"defaultValue": map[string]string{"language": "en-US", "value": value},
+		}
+	}
+	gw := s.googleWallet
+	class := map[string]interface{}{
+		"id":                 googleWalletID(gw.issuerID, "event", event.Slug),
+		"issuerName":         passOrganization,
+		"eventName":          localized(event.Name),
+		"reviewStatus":       "UNDER_REVIEW",
+		"hexBackgroundColor": "#002e5d",
+	}
+	if len(event.Venue) > 0 {
+		class["venue"] = map[string]interface{}{
+			"name":    localized(event.Venue),
+			"address": localized(event.Venue),
+		}
+	}
+	if !event.Date.IsZero() {
+		class["dateTime"] = map[string]string{"start": event.Date.Format(time.RFC3339)}
+	}
+	object := map[string]interface{}{
+		"id":               googleWalletID(gw.issuerID, "ticket", ticket.ID),
+		"classId":          class["id"],
+		"state":            "ACTIVE",
+		"ticketHolderName": ticket.FirstName + " " + ticket.LastName,
+		"ticketNumber":     ticket.ID,
+		"barcode": map[string]string{
+			"type":          "QR_CODE",
+			"value":         ticket.URL(token),
+			"alternateText": ticket.ID,
+		},
+	}
+	if len(typeName) > 0 {
+		object["ticketType"] = localized(typeName)
+	}
+	jwt, err := gw.signJWT(map[string]interface{}{
+		"iss":     gw.clientEmail,
+		"aud":     "google",
+		"typ":     "savetowallet",
+		"iat":     now().Unix(),
+		"origins": []string{},
+		"payload": map[string]interface{}{
+			"eventTicketClasses": []interface{}{class},
+			"eventTicketObjects": []interface{}{object},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return "https://pay.google.com/gp/v/save/" + jwt, nil
+}
+
+// saveToGoogleWallet redirects to the Google Wallet save link of a ticket.
+func (s *server) saveToGoogleWallet(w http.ResponseWriter, r *http.Request) {
+	if s.googleWallet == nil {
+		s.err(w, errors.New("Google Wallet is not configured"), 404)
+		return
+	}
+	token := mux.Vars(r)["token"]
+	ticket, err := s.ticketByToken(token)
+	if err != nil {
+		s.ticketErr(w, err)
+		return
+	}
+	url, err := s.googleWalletURL(ticket, token)
+	if err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// walletLinks fills in the wallet links of a ticket for whichever wallets are
+// set up.
+func (s *server) walletLinks(resp *TicketResponse, token string) {
+	if s.passes != nil {
+		resp.AppleWalletURL = "/api/ticket/" + token + ".pkpass"
+	}
+	if s.googleWallet != nil {
+		resp.GoogleWalletURL = "/api/ticket/" + token + "/googleWallet"
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/ubccsss/square-invoice-tickets/square"
+)
+
+// squareWebhook receives Square invoice notifications and runs the paid
+// invoice through the same path as the poller.
+func (s *server) squareWebhook(w http.ResponseWriter, r *http.Request) {
+	if len(*squareWebhookKey) == 0 {
+		s.err(w, errors.New("webhooks are not configured"), 404)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		s.err(w, err, 400)
+		return
+	}
+	sig := r.Header.Get(square.WebhookSignatureHeader)
+	if !square.VerifyWebhook(*squareWebhookKey, *squareWebhookURL, body, sig) {
+		s.err(w, errors.New("invalid signature"), 401)
+		return
+	}
+	event, err := square.ParseWebhook(body)
+	if err != nil {
+		s.err(w, err, 400)
+		return
+	}
+	log.Printf("square webhook %s %s", event.Type, event.EventID)
+	if event.Invoice == nil {
+		return
+	}
+	if err := s.processInvoice(event.Invoice); err != nil {
+		s.err(w, err, 500)
+		return
+	}
+	// A canceled invoice may have freed seats for the waitlist.
+	s.inviteWaitlists()
+}